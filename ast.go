@@ -0,0 +1,193 @@
+package main
+
+import "strconv"
+
+// NodeKind 语法树节点的类型
+type NodeKind int
+
+const (
+	NodeText     NodeKind = iota // 普通文本，包括 #raw 块的内容
+	NodeExpr                     // ${ expr } 或 #( expr ) 表达式
+	NodeSet                      // #set / #let 变量定义
+	NodeIf                       // #if 条件
+	NodeSwitch                   // #switch 多路选择
+	NodeFor                      // #for 循环
+	NodeBreak                    // #break
+	NodeContinue                 // #continue
+	NodeDefine                   // #define 宏定义
+	NodeCall                     // #call 宏调用
+	NodeBlock                    // #block 可覆盖区域
+	NodeInclude                  // #include 文件包含
+	NodeExtends                  // #extends 父模板
+)
+
+var nodeKindNames = [...]string{
+	NodeText:     "text",
+	NodeExpr:     "expr",
+	NodeSet:      "set",
+	NodeIf:       "if",
+	NodeSwitch:   "switch",
+	NodeFor:      "for",
+	NodeBreak:    "break",
+	NodeContinue: "continue",
+	NodeDefine:   "define",
+	NodeCall:     "call",
+	NodeBlock:    "block",
+	NodeInclude:  "include",
+	NodeExtends:  "extends",
+}
+
+// String 返回节点类型的名称，指令节点为不带前缀的指令关键字
+func (k NodeKind) String() string {
+	if k >= 0 && int(k) < len(nodeKindNames) {
+		return nodeKindNames[k]
+	}
+	return "NodeKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Node 模板语法树中的节点
+// Node 是解析结果的只读副本，修改它不会影响模板的渲染
+type Node struct {
+	Kind NodeKind
+	Line int // 节点在模板源码中的起始行号，从 1 开始
+
+	Text string // NodeText 的文本
+	// Expr 节点的表达式源码：NodeExpr 的表达式、NodeSet 的值、NodeIf 的条件、NodeSwitch 的比较对象、
+	// NodeFor 的可迭代对象、NodeBreak / NodeContinue 的 if 条件、NodeInclude 的 with 参数，没有时为空
+	Expr string
+	// Name NodeSet 的变量名、NodeDefine / NodeCall 的宏名、NodeBlock 的区域名、NodeInclude / NodeExtends 的模板路径
+	Name   string
+	Vars   []string // NodeFor 的循环变量、NodeDefine 的参数
+	Args   []string // NodeCall 的参数表达式
+	Filter string   // NodeFor 的 if 子句
+
+	Sorted   bool   // NodeFor 带有 sorted 修饰
+	Reversed bool   // NodeFor 带有 reversed 修饰
+	Only     bool   // NodeInclude 带有 only
+	Indent   string // NodeInclude 的缩进选项：noindent 或 indent N，没有时为空（按指令所在列缩进）
+
+	Branches []Branch // 复合节点的子块，按源码顺序排列
+}
+
+// Branch 复合节点中的一个子块
+type Branch struct {
+	// Keyword 开始该子块的指令关键字（不含前缀）：if、elif、else、case、default、for、define、block
+	Keyword string
+	Line    int      // 关键字所在行号
+	Exprs   []string // if / elif 的条件，case 的候选值，其他子块为空
+	Nodes   []Node
+}
+
+// Nodes 返回模板顶层节点的只读副本
+// 使用了 #extends 的模板第一个节点为 NodeExtends
+func (t *Template) Nodes() []Node {
+	var out []Node
+	if t.extends != "" {
+		out = append(out, Node{Kind: NodeExtends, Line: t.extendsLine, Name: t.extends})
+	}
+	return append(out, exportNodes(t.nodes)...)
+}
+
+// Walk 按源码顺序深度优先遍历模板的语法树
+// fn 返回 false 时跳过该节点的子块，继续遍历其后的节点
+func (t *Template) Walk(fn func(Node) bool) {
+	walkNodes(t.Nodes(), fn)
+}
+
+// walkNodes 依次遍历节点及其子块
+func walkNodes(nodes []Node, fn func(Node) bool) {
+	for _, n := range nodes {
+		if !fn(n) {
+			continue
+		}
+		for _, b := range n.Branches {
+			walkNodes(b.Nodes, fn)
+		}
+	}
+}
+
+// exportNodes 将内部节点转换为语法树节点
+func exportNodes(nodes []node) []Node {
+	out := make([]Node, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, exportNode(n))
+	}
+	return out
+}
+
+// exportNode 将一个内部节点转换为语法树节点
+func exportNode(n node) Node {
+	switch n := n.(type) {
+	case *textNode:
+		return Node{Kind: NodeText, Line: n.line, Text: n.text}
+	case *exprNode:
+		return Node{Kind: NodeExpr, Line: n.line, Expr: n.code}
+	case *setNode:
+		return Node{Kind: NodeSet, Line: n.line, Name: n.name, Expr: n.value.code}
+	case *ifNode:
+		out := Node{Kind: NodeIf, Line: n.line, Expr: n.cond.code}
+		out.Branches = append(out.Branches, Branch{Keyword: "if", Line: n.line, Exprs: []string{n.cond.code}, Nodes: exportNodes(n.thenN)})
+		for _, b := range n.elifs {
+			out.Branches = append(out.Branches, Branch{Keyword: "elif", Line: b.line, Exprs: []string{b.cond.code}, Nodes: exportNodes(b.body)})
+		}
+		if n.elseLine > 0 {
+			out.Branches = append(out.Branches, Branch{Keyword: "else", Line: n.elseLine, Nodes: exportNodes(n.elseN)})
+		}
+		return out
+	case *switchNode:
+		out := Node{Kind: NodeSwitch, Line: n.line, Expr: n.subject.code}
+		for _, c := range n.cases {
+			out.Branches = append(out.Branches, Branch{Keyword: "case", Line: c.line, Exprs: programCodes(c.values), Nodes: exportNodes(c.body)})
+		}
+		if n.defaultLine > 0 {
+			out.Branches = append(out.Branches, Branch{Keyword: "default", Line: n.defaultLine, Nodes: exportNodes(n.defaultN)})
+		}
+		return out
+	case *forNode:
+		out := Node{Kind: NodeFor, Line: n.line, Expr: n.iter.code, Vars: []string{n.varName}, Sorted: n.sorted, Reversed: n.reversed}
+		if n.varName2 != "" {
+			out.Vars = append(out.Vars, n.varName2)
+		}
+		if n.filter != nil {
+			out.Filter = n.filter.code
+		}
+		out.Branches = append(out.Branches, Branch{Keyword: "for", Line: n.line, Nodes: exportNodes(n.body)})
+		if n.elseLine > 0 {
+			out.Branches = append(out.Branches, Branch{Keyword: "else", Line: n.elseLine, Nodes: exportNodes(n.elseN)})
+		}
+		return out
+	case *loopCtlNode:
+		out := Node{Kind: NodeContinue, Line: n.line}
+		if n.brk {
+			out.Kind = NodeBreak
+		}
+		if n.cond != nil {
+			out.Expr = n.cond.code
+		}
+		return out
+	case *macroNode:
+		return Node{Kind: NodeDefine, Line: n.line, Name: n.name, Vars: append([]string(nil), n.params...),
+			Branches: []Branch{{Keyword: "define", Line: n.line, Nodes: exportNodes(n.body)}}}
+	case *callNode:
+		return Node{Kind: NodeCall, Line: n.line, Name: n.name, Args: programCodes(n.args)}
+	case *blockNode:
+		return Node{Kind: NodeBlock, Line: n.line, Name: n.name,
+			Branches: []Branch{{Keyword: "block", Line: n.line, Nodes: exportNodes(n.body)}}}
+	case *includeNode:
+		out := Node{Kind: NodeInclude, Line: n.line, Name: n.path, Only: n.only, Indent: n.indentOpt}
+		if n.with != nil {
+			out.Expr = n.with.code
+		}
+		return out
+	}
+	panic("htpl: unknown node type")
+}
+
+// programCodes 返回表达式列表的源码
+func programCodes(progs []*program) []string {
+	codes := make([]string, len(progs))
+	for i, p := range progs {
+		codes[i] = p.code
+	}
+	return codes
+}
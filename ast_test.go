@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// describeNode 将非文本节点描述为 "类型@行号 名称 表达式 修饰" 形式，便于比较遍历结果
+func describeNode(n Node) string {
+	parts := []string{fmt.Sprintf("%s@%d", n.Kind, n.Line)}
+	for _, s := range []string{n.Name, n.Expr, n.Filter} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	parts = append(parts, n.Vars...)
+	parts = append(parts, n.Args...)
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{{n.Sorted, "sorted"}, {n.Reversed, "reversed"}, {n.Only, "only"}, {n.Indent != "", n.Indent}} {
+		if flag.set {
+			parts = append(parts, "["+flag.name+"]")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// TestWalk 测试按源码顺序遍历语法树
+func TestWalk(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		expected []string
+	}{
+		{
+			name:     "表达式和变量定义",
+			template: "#set ns = namespace ?? \"default\"\nname: ${appName}-${ns}",
+			expected: []string{`set@1 ns namespace ?? "default"`, "expr@2 appName", "expr@2 ns"},
+		},
+		{
+			name: "条件分支",
+			template: `#if replicas > 1
+ha: ${replicas}
+#elif replicas == 1
+single: true
+#else
+#include "test_ast_partial.tpl" with {"x": 1}
+#end`,
+			expected: []string{"if@1 replicas > 1", "expr@2 replicas", `include@6 test_ast_partial.tpl {"x": 1}`},
+		},
+		{
+			name: "循环和循环控制",
+			template: `#for i, c in containers if c.enabled
+#break if i > 2
+- ${c.name}
+#continue if !c.public
+#else
+- ${fallback}
+#end`,
+			expected: []string{"for@1 containers c.enabled i c", "break@2 i > 2", "expr@3 c.name", "continue@4 !c.public", "expr@6 fallback"},
+		},
+		{
+			name: "循环和包含的修饰",
+			template: `#for k, v in labels sorted reversed
+#include "a.tpl" with {"k": k} only indent 4
+#end
+  #include "b.tpl" noindent
+  #include "c.tpl"`,
+			expected: []string{
+				"for@1 labels k v [sorted] [reversed]",
+				`include@2 a.tpl {"k": k} [only] [indent 4]`,
+				"include@4 b.tpl [noindent]",
+				"include@5 c.tpl",
+			},
+		},
+		{
+			name: "多路选择",
+			template: `#switch cloud
+#case "aws", "eks"
+${region}
+#default
+#end`,
+			expected: []string{"switch@1 cloud", "expr@3 region"},
+		},
+		{
+			name: "宏和区域",
+			template: `#define label(key, value)
+${key}: ${value}
+#end
+#block labels
+#call label("app", appName)
+#end`,
+			expected: []string{"define@1 label key value", "expr@2 key", "expr@2 value", "block@4 labels", `call@5 label "app" appName`},
+		},
+		{
+			name:     "跨行表达式使用起始行号",
+			template: "a: ${\n  x +\n  y\n} b: ${z}",
+			expected: []string{"expr@1 x +\n  y", "expr@4 z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			var got []string
+			tpl.Walk(func(n Node) bool {
+				if n.Kind != NodeText {
+					got = append(got, describeNode(n))
+				}
+				return true
+			})
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestWalkBranches 测试复合节点的子块
+func TestWalkBranches(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString(`#if a
+A
+#elif b
+B
+#else
+C
+#end
+#for x in items
+${x}
+#else
+none
+#end`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	nodes := tpl.Nodes()
+	if len(nodes) != 2 {
+		t.Fatalf("期望 2 个顶层节点，实际: %d", len(nodes))
+	}
+
+	var got []string
+	for _, n := range nodes {
+		for _, b := range n.Branches {
+			var texts []string
+			for _, c := range b.Nodes {
+				texts = append(texts, c.Text+c.Expr)
+			}
+			got = append(got, fmt.Sprintf("%s@%d %q %q", b.Keyword, b.Line, b.Exprs, strings.Join(texts, "")))
+		}
+	}
+	expected := []string{
+		`if@1 ["a"] "A\n"`,
+		`elif@3 ["b"] "B\n"`,
+		`else@5 [] "C\n"`,
+		`for@8 [] "x\n"`,
+		`else@10 [] "none\n"`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("期望: %q, 实际: %q", expected, got)
+	}
+}
+
+// TestWalkSkipChildren 测试回调返回 false 时跳过子块
+func TestWalkSkipChildren(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString(`#for c in containers
+${c.name}
+#end
+${appName}`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	var got []string
+	tpl.Walk(func(n Node) bool {
+		if n.Kind == NodeExpr {
+			got = append(got, n.Expr)
+		}
+		return n.Kind != NodeFor
+	})
+	if expected := []string{"appName"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("期望: %q, 实际: %q", expected, got)
+	}
+}
+
+// TestNodesExtends 测试使用 #extends 的模板以 NodeExtends 开头
+func TestNodesExtends(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString(`#extends "base.tpl"
+#block body
+hello
+#end`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	nodes := tpl.Nodes()
+	if len(nodes) == 0 || nodes[0].Kind != NodeExtends || nodes[0].Name != "base.tpl" || nodes[0].Line != 1 {
+		t.Fatalf("期望第一个节点为 #extends，实际: %+v", nodes)
+	}
+	if nodes[0].Kind.String() != "extends" {
+		t.Errorf("期望: %q, 实际: %q", "extends", nodes[0].Kind.String())
+	}
+}
+
+// TestNodesReadOnly 测试修改语法树不影响模板渲染
+func TestNodesReadOnly(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString("#if enabled\nname: ${appName}\n#end")
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	nodes := tpl.Nodes()
+	nodes[0].Expr = "false"
+	nodes[0].Branches[0].Nodes[1].Expr = "other"
+
+	result, err := tpl.Render(map[string]any{"enabled": true, "appName": "web"})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "name: web\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+}
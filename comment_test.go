@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestTemplateComments 测试模板注释不会出现在输出中
+func TestTemplateComments(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "注释行整行删除",
+			template: `#-- 维护说明：name 由 CI 注入
+name: ${appName}
+  #-- 缩进的注释行`,
+			context:  map[string]any{"appName": "web"},
+			expected: "name: web\n",
+		},
+		{
+			name:     "行内注释块",
+			template: `replicas: ${replicas} #* 生产环境至少 3 个 *#`,
+			context:  map[string]any{"replicas": 3},
+			expected: "replicas: 3 ",
+		},
+		{
+			name: "跨行注释块",
+			template: `#*
+  这个模板由平台组维护
+  修改前请联系 owner
+*#
+kind: Service`,
+			context:  map[string]any{},
+			expected: "kind: Service",
+		},
+		{
+			name: "注释块后面的文本保留",
+			template: `a: 1 #* 开始
+结束 *# b: 2
+c: 3`,
+			context:  map[string]any{},
+			expected: "a: 1  b: 2\nc: 3",
+		},
+		{
+			name: "注释中的指令和表达式不生效",
+			template: `#-- #if debug
+#* ${missing.value} #end *#
+ok`,
+			context:  map[string]any{},
+			expected: "ok",
+		},
+		{
+			name: "循环中的注释",
+			template: `#for p in ports
+#-- 每个端口一行
+- ${p}
+#end`,
+			context:  map[string]any{"ports": []int{80, 443}},
+			expected: "- 80\n- 443\n",
+		},
+		{
+			name: "YAML注释保持原样",
+			template: `# 输出注释
+#---------
+## section`,
+			context:  map[string]any{},
+			expected: "# 输出注释\n#---------\n## section",
+		},
+		{
+			name:     "未闭合的注释块保持原样",
+			template: `pattern: /api/#*`,
+			context:  map[string]any{},
+			expected: "pattern: /api/#*",
+		},
+		{
+			name: "紧跟在其他字符后的#*不是注释",
+			template: `glob: src/#*.go
+note: a#* b *#`,
+			context:  map[string]any{},
+			expected: "glob: src/#*.go\nnote: a#* b *#",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestCommentLineNumbers 测试注释不影响错误行号
+func TestCommentLineNumbers(t *testing.T) {
+	eng := New(os.DirFS("."))
+	tpl := `#*
+说明
+*#
+#-- 注释
+#if true
+x`
+	_, err := eng.ParseString(tpl)
+	if err == nil {
+		t.Fatal("期望解析错误")
+	}
+	if want := "line 5: unterminated #if: missing #end"; err.Error() != want {
+		t.Errorf("期望: %q, 实际: %q", want, err.Error())
+	}
+}
+
+// TestCommentShellParameterExpansion 测试 Shell 参数展开中的 #* 不会开始注释块
+func TestCommentShellParameterExpansion(t *testing.T) {
+	eng := New(os.DirFS("."), WithDelimiters("{{", "}}"))
+	tpl, err := eng.ParseString(`base="${f##*/}"
+echo {{ name }}
+rm "$dir"/*#backup`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err := tpl.Render(map[string]any{"name": "web"})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "base=\"${f##*/}\"\necho web\nrm \"$dir\"/*#backup"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+}
+
+// TestCommentUnclosedLongTemplate 测试未闭合的注释块后面有大量行时解析仍然是线性的
+func TestCommentUnclosedLongTemplate(t *testing.T) {
+	eng := New(os.DirFS("."))
+	var sb strings.Builder
+	for i := 0; i < 20000; i++ {
+		sb.WriteString("#* unclosed\nkey: value\n")
+	}
+	template := sb.String()
+	tpl, err := eng.ParseString(template)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err := tpl.Render(map[string]any{})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if result != template {
+		t.Errorf("未闭合的注释块应保持原样")
+	}
+}
@@ -249,6 +249,117 @@ Guest user
 	}
 }
 
+// TestElifChains 测试 #elif / #else if 多分支条件
+func TestElifChains(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	envTemplate := `#if env == "dev"
+replicas: 1
+#elif env == "staging"
+replicas: 2
+#else if env == "prod"
+replicas: 5
+#else
+replicas: 0
+#end`
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "第一个分支成立",
+			template: envTemplate,
+			context:  map[string]any{"env": "dev"},
+			expected: "replicas: 1\n",
+		},
+		{
+			name:     "elif分支成立",
+			template: envTemplate,
+			context:  map[string]any{"env": "staging"},
+			expected: "replicas: 2\n",
+		},
+		{
+			name:     "else if分支成立",
+			template: envTemplate,
+			context:  map[string]any{"env": "prod"},
+			expected: "replicas: 5\n",
+		},
+		{
+			name:     "所有条件都不成立时走else",
+			template: envTemplate,
+			context:  map[string]any{"env": "test"},
+			expected: "replicas: 0\n",
+		},
+		{
+			name: "没有else且所有条件都不成立",
+			template: `#if size == "small"
+cpu: 100m
+#elif size == "medium"
+cpu: 500m
+#end
+done`,
+			context:  map[string]any{"size": "large"},
+			expected: "done",
+		},
+		{
+			name: "多个条件成立时只渲染第一个",
+			template: `#if count > 100
+large
+#elif count > 10
+medium
+#elif count > 0
+small
+#end`,
+			context:  map[string]any{"count": 50},
+			expected: "medium\n",
+		},
+		{
+			name: "elif分支中的嵌套指令",
+			template: `#if mode == "a"
+A
+#elif mode == "b"
+#for item in items
+- ${item}
+#end
+#if verbose
+verbose
+#elif quiet
+quiet
+#end
+#end`,
+			context: map[string]any{
+				"mode":    "b",
+				"items":   []string{"x", "y"},
+				"verbose": false,
+				"quiet":   true,
+			},
+			expected: "- x\n- y\nquiet\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
 // TestConditionalEdgeCases 测试条件语句的边界情况
 func TestConditionalEdgeCases(t *testing.T) {
 	loader := os.DirFS(".")
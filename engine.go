@@ -1,52 +1,289 @@
 package main
 
 import (
+	"fmt"
 	"io/fs"
+	"path"
 	"strings"
+	"sync"
 )
 
 // Engine 模板引擎结构体
 type Engine struct {
 	Loader fs.FS // where #include reads files from; use os.DirFS(root)
+
+	syntax            *syntax // 指令前缀和表达式分隔符，为 nil 时使用默认语法
+	normalizeNewlines bool    // 为 true 时输出统一使用 \n 换行，并保证以换行结尾
+	maxIncludeDepth   int     // #include 的最大嵌套层数，为 0 时使用 defaultMaxIncludeDepth
+	maxMacroDepth     int     // 宏调用的最大嵌套层数，为 0 时使用 defaultMaxMacroDepth
+
+	programs  sync.Map // 表达式源码到 *program 的缓存，由该引擎解析的所有模板共享
+	templates sync.Map // #include / #extends 引用的模板路径到 *Template 的缓存
+}
+
+// defaultMaxIncludeDepth #include 默认的最大嵌套层数
+const defaultMaxIncludeDepth = 32
+
+// defaultMaxMacroDepth 宏调用默认的最大嵌套层数
+const defaultMaxMacroDepth = 64
+
+// Option 创建 Engine 时的配置项
+type Option func(*Engine)
+
+// WithDirectivePrefix 设置指令前缀，默认为 #
+// 例如设置为 #@ 后，指令写作 #@if / #@for / #@end，前缀形式的表达式写作 #@( ... )，
+// 注释写作 #@-- 和 #@* ... *#@，普通的 # 注释行不再与指令冲突
+func WithDirectivePrefix(prefix string) Option {
+	return func(e *Engine) {
+		e.syntax.prefix = prefix
+	}
+}
+
+// WithDelimiters 设置表达式分隔符，默认为 ${ 和 }
+// 例如 WithDelimiters("{{", "}}") 后表达式写作 {{ name }}，Shell 和 Terraform 中的 ${VAR} 原样输出
+func WithDelimiters(open, close string) Option {
+	return func(e *Engine) {
+		e.syntax.open, e.syntax.close = open, close
+	}
 }
 
 // Template 模板结构体
 type Template struct {
 	engine *Engine
+	path   string // ParseFile 读取的模板路径，ParseString 解析的模板为空
 	nodes  []node
+	macros map[string]*macroNode // #define 定义的宏
+
+	// 模板继承
+	extends     string                // #extends 指定的父模板路径，为空表示没有父模板
+	extendsLine int                   // #extends 所在行号
+	blocks      map[string]*blockNode // #block 定义的可覆盖区域
+}
+
+// WithNormalizedNewlines 统一输出的换行符
+// 默认情况下输出与模板源码逐字节一致：保留每行的 \n 或 \r\n，源码末尾没有换行时输出末尾也没有；
+// 使用该选项后所有换行符转换为 \n，并且每行（包括最后一行）都以 \n 结尾
+func WithNormalizedNewlines() Option {
+	return func(e *Engine) {
+		e.normalizeNewlines = true
+	}
+}
+
+// WithMaxIncludeDepth 设置 #include 的最大嵌套层数，默认为 32
+// 嵌套超过该层数时渲染报错并给出完整的包含链；n 小于 1 时 New panic
+func WithMaxIncludeDepth(n int) Option {
+	return func(e *Engine) {
+		if n < 1 {
+			panic(fmt.Sprintf("htpl: invalid max include depth %d", n))
+		}
+		e.maxIncludeDepth = n
+	}
+}
+
+// WithMaxMacroDepth 设置宏调用（#call 或表达式中调用宏）的最大嵌套层数，默认为 64
+// 递归调用超过该层数时渲染报错并给出完整的调用链；n 小于 1 时 New panic
+func WithMaxMacroDepth(n int) Option {
+	return func(e *Engine) {
+		if n < 1 {
+			panic(fmt.Sprintf("htpl: invalid max macro depth %d", n))
+		}
+		e.maxMacroDepth = n
+	}
 }
 
 // New 创建新的模板引擎实例
-func New(loader fs.FS) *Engine {
-	return &Engine{Loader: loader}
+// 前缀或分隔符为空、最大包含层数或宏调用层数小于 1 时 panic
+func New(loader fs.FS, opts ...Option) *Engine {
+	if len(opts) == 0 {
+		return &Engine{Loader: loader, syntax: defaultSyntax}
+	}
+	e := &Engine{Loader: loader, syntax: &syntax{prefix: defaultSyntax.prefix, open: defaultSyntax.open, close: defaultSyntax.close}}
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.syntax.compile()
+	return e
+}
+
+// syn 返回引擎使用的语法，直接构造的 Engine 使用默认语法
+func (e *Engine) syn() *syntax {
+	if e.syntax == nil {
+		return defaultSyntax
+	}
+	return e.syntax
 }
 
 // ParseString 解析字符串模板
+// 模板中 #include / #extends 的相对路径相对于 Loader 的根目录
 func (e *Engine) ParseString(s string) (*Template, error) {
-	p := newParser(s)
+	return e.parse(s, "")
+}
+
+// ParseFile 解析文件模板
+// 模板会记住自己的路径，其中 #include / #extends 的相对路径相对于该文件所在的目录
+func (e *Engine) ParseFile(path string) (*Template, error) {
+	b, err := fs.ReadFile(e.Loader, path)
+	if err != nil {
+		return nil, err
+	}
+	return e.parse(string(b), path)
+}
+
+// parse 解析模板源码，path 为模板路径，没有路径时为空
+func (e *Engine) parse(s, path string) (*Template, error) {
+	p := newParser(s, e)
+	p.path = path
 	nodes, err := p.parse()
 	if err != nil {
 		return nil, err
 	}
-	return &Template{engine: e, nodes: nodes}, nil
+	return &Template{
+		engine:      e,
+		path:        path,
+		nodes:       nodes,
+		macros:      p.macros,
+		extends:     p.extends,
+		extendsLine: p.extendsLine,
+		blocks:      p.blocks,
+	}, nil
 }
 
-// ParseFile 解析文件模板
-func (e *Engine) ParseFile(path string) (*Template, error) {
-	b, err := fs.ReadFile(e.Loader, path)
+// Path 返回模板的路径，通过 ParseString 解析的模板返回空字符串
+func (t *Template) Path() string {
+	return t.path
+}
+
+// resolvePath 解析 #include / #extends 中的模板路径，返回相对于 Loader 根目录的路径
+// 以 / 开头的路径相对于 Loader 的根目录，其他路径相对于 from 所在的目录，
+// from 为空（ParseString 解析的模板）时相对于根目录
+func resolvePath(from, name string) string {
+	if strings.HasPrefix(name, "/") {
+		return path.Clean(name[1:])
+	}
+	return path.Join(path.Dir(from), name)
+}
+
+// include 返回 #include 或 #extends 引用的模板，每个路径只读取和解析一次，之后的渲染和变量分析直接使用缓存的模板
+// 读取或解析失败时不缓存，下次渲染时重试
+func (e *Engine) include(path string) (*Template, error) {
+	if t, ok := e.templates.Load(path); ok {
+		return t.(*Template), nil
+	}
+	t, err := e.ParseFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return e.ParseString(string(b))
+	actual, _ := e.templates.LoadOrStore(path, t)
+	return actual.(*Template), nil
+}
+
+// includeDepth 返回 #include 的最大嵌套层数
+func (e *Engine) includeDepth() int {
+	if e.maxIncludeDepth == 0 {
+		return defaultMaxIncludeDepth
+	}
+	return e.maxIncludeDepth
+}
+
+// macroDepth 返回宏调用的最大嵌套层数
+func (e *Engine) macroDepth() int {
+	if e.maxMacroDepth == 0 {
+		return defaultMaxMacroDepth
+	}
+	return e.maxMacroDepth
+}
+
+// compile 返回表达式的预编译程序，相同源码的表达式只编译一次
+func (e *Engine) compile(code string) *program {
+	if p, ok := e.programs.Load(code); ok {
+		return p.(*program)
+	}
+	p, _ := e.programs.LoadOrStore(code, compileProgram(code))
+	return p.(*program)
 }
 
 // Render 渲染模板，返回渲染后的字符串
+// 渲染在 ctx 的副本上进行，调用方传入的 map 不会被修改
 func (t *Template) Render(ctx map[string]any) (string, error) {
+	scope := t.newScope(ctx)
+	if t.extends != "" {
+		return t.renderExtends(scope)
+	}
+
 	var sb strings.Builder
 	for _, n := range t.nodes {
-		if err := n.render(&sb, t.engine, ctx); err != nil {
+		if err := n.render(&sb, t.engine, scope); err != nil {
 			return "", err
 		}
 	}
 	return sb.String(), nil
 }
+
+// newScope 基于调用方上下文创建本次渲染使用的作用域，并注册模板中定义的宏
+func (t *Template) newScope(ctx map[string]any) map[string]any {
+	scope := make(map[string]any, len(ctx)+len(builtins)+len(t.macros)+1)
+	for k, v := range ctx {
+		scope[k] = v
+	}
+	withBuiltins(scope)
+	inherited, _ := scope[macrosKey].(map[string]*macroNode)
+	if len(t.macros) == 0 && len(inherited) == 0 {
+		return scope
+	}
+
+	// 合并从外层模板（例如 #include 的调用方）继承的宏，本模板定义的同名宏优先；
+	// 继承的宏也重新绑定到本作用域，使其在表达式中调用时使用本模板的 #include 链
+	macros := make(map[string]*macroNode, len(inherited)+len(t.macros))
+	for name, m := range inherited {
+		macros[name] = m
+	}
+	for name, m := range t.macros {
+		macros[name] = m
+	}
+	bindMacros(scope, t.engine, macros)
+	return scope
+}
+
+// renderExtends 渲染继承了父模板的模板
+// 子模板顶层的 #set 先在作用域中执行，其余 #block 之外的内容被忽略；
+// 然后以子模板中的 #block 作为覆盖渲染父模板
+func (t *Template) renderExtends(scope map[string]any) (string, error) {
+	for _, n := range t.nodes {
+		if s, ok := n.(*setNode); ok {
+			if err := s.render(nil, t.engine, scope); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	path := resolvePath(t.path, t.extends)
+	chain, _ := scope[extendsKey].([]string)
+	for _, visited := range chain {
+		if visited == path {
+			return "", fmt.Errorf("line %d: #extends cycle: %s -> %s", t.extendsLine, strings.Join(chain, " -> "), path)
+		}
+	}
+	scope[extendsKey] = append(chain[:len(chain):len(chain)], path)
+
+	// 越靠近子模板的覆盖排在越前面
+	blocks := map[string][]*blockNode{}
+	if inherited, ok := scope[blocksKey].(map[string][]*blockNode); ok {
+		for name, chain := range inherited {
+			blocks[name] = chain
+		}
+	}
+	for name, b := range t.blocks {
+		blocks[name] = append(append([]*blockNode(nil), blocks[name]...), b)
+	}
+	scope[blocksKey] = blocks
+
+	parent, err := t.engine.include(path)
+	if err != nil {
+		return "", fmt.Errorf("line %d: #extends %q: %w", t.extendsLine, t.extends, err)
+	}
+	out, err := parent.Render(scope)
+	if err != nil {
+		return "", fmt.Errorf("line %d: #extends %q: %w", t.extendsLine, t.extends, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestEscapeSyntax 测试表达式和指令的转义语法
+func TestEscapeSyntax(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "转义美元表达式",
+			template: `echo "\${HOME}/${appName}"`,
+			context:  map[string]any{"appName": "web"},
+			expected: "echo \"${HOME}/web\"",
+		},
+		{
+			name:     "Helm风格的占位符",
+			template: `image: \${IMAGE_TAG} # rendered for ${appName}`,
+			context:  map[string]any{"appName": "web"},
+			expected: "image: ${IMAGE_TAG} # rendered for web",
+		},
+		{
+			name:     "转义井号表达式",
+			template: `literal: \#(1 + 1), value: #(1 + 1)`,
+			context:  map[string]any{},
+			expected: "literal: #(1 + 1), value: 2",
+		},
+		{
+			name: "转义的if指令行",
+			template: `##if you change this, also update the chart
+name: ${appName}`,
+			context:  map[string]any{"appName": "web"},
+			expected: "#if you change this, also update the chart\nname: web",
+		},
+		{
+			name: "带缩进的转义指令行",
+			template: `config:
+  ##for each replica we add a sidecar
+  ##include "notes.txt"
+  ##end`,
+			context:  map[string]any{},
+			expected: "config:\n  #for each replica we add a sidecar\n  #include \"notes.txt\"\n  #end",
+		},
+		{
+			name:     "转义行中的表达式仍然会被计算",
+			template: `##set value = ${value}`,
+			context:  map[string]any{"value": 42},
+			expected: "#set value = 42",
+		},
+		{
+			name: "普通的双井号注释保持原样",
+			template: `## Section header
+##endpoint settings`,
+			context:  map[string]any{},
+			expected: "## Section header\n##endpoint settings",
+		},
+		{
+			name:     "两个反斜杠表示反斜杠加表达式",
+			template: `path: C:\dir\\${name}, literal: \${name}`,
+			context:  map[string]any{"name": "web"},
+			expected: `path: C:\dir\web, literal: ${name}`,
+		},
+		{
+			name: "跨行表达式前的两个反斜杠",
+			template: `path: \\${ name +
+  "-x" }`,
+			context:  map[string]any{"name": "web"},
+			expected: `path: \web-x`,
+		},
+		{
+			name: "循环中的转义",
+			template: `#for v in vars
+export ${v}="\${HOME}/${v}"
+#end`,
+			context:  map[string]any{"vars": []string{"A", "B"}},
+			expected: "export A=\"${HOME}/A\"\nexport B=\"${HOME}/B\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
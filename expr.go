@@ -3,12 +3,19 @@ package main
 import (
 	"fmt"
 	"math"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	expr "github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/builtin"
+	exprparser "github.com/expr-lang/expr/parser"
+	"github.com/expr-lang/expr/vm"
 )
 
 // nullCoalesceFunc 实现空安全运算符 ?? 的逻辑
@@ -24,13 +31,19 @@ func nullCoalesceFunc(a, b any) any {
 	return a
 }
 
+// 表达式预处理使用的正则表达式
+var (
+	reNullCoalescing = regexp.MustCompile(`([^?]+?)\s*\?\?\s*(.+)`)
+	reIndexAccess    = regexp.MustCompile(`(\w+)\[(\d+)\]`)
+	reNestedProp     = regexp.MustCompile(`(\w+)\.(\w+(?:\.\w+)*)`)
+)
+
 // preprocessNullCoalescing 预处理空安全运算符 ??
 // 将 "a ?? b" 转换为 "nullCoalesce(a, b)"
 func preprocessNullCoalescing(code string) string {
 	// 处理 ?? 运算符 - 递归处理所有的 ?? 运算符
-	re := regexp.MustCompile(`([^?]+?)\s*\?\?\s*(.+)`)
-	for re.MatchString(code) {
-		matches := re.FindStringSubmatch(code)
+	for reNullCoalescing.MatchString(code) {
+		matches := reNullCoalescing.FindStringSubmatch(code)
 		if len(matches) == 3 {
 			left := strings.TrimSpace(matches[1])
 			right := strings.TrimSpace(matches[2])
@@ -43,8 +56,7 @@ func preprocessNullCoalescing(code string) string {
 			
 			// 对于数组索引访问，使用safeIndex包装
 			if strings.Contains(left, "[") && strings.Contains(left, "]") {
-				re2 := regexp.MustCompile(`(\w+)\[(\d+)\]`)
-				left = re2.ReplaceAllString(left, "safeIndex($1, $2)")
+				left = reIndexAccess.ReplaceAllString(left, "safeIndex($1, $2)")
 			}
 			
 			// 递归处理右侧部分
@@ -109,70 +121,271 @@ func safeIndex(arr any, index int) any {
 	}
 }
 
-// evalExpr 计算表达式的值
-func evalExpr(code string, ctx map[string]any) (any, error) {
-	// 预处理空安全运算符
-	code = preprocessNullCoalescing(code)
-
-	// 创建环境并添加自定义函数和Go标准库函数
-	env := map[string]any{
-		"nullCoalesce": nullCoalesceFunc,
-		"safeGet":     safeGet,
-		"safeIndex":   safeIndex,
-		// strings 包函数
-		"strings": map[string]any{
-			"ToUpper":    strings.ToUpper,
-			"ToLower":    strings.ToLower,
-			"TrimSpace":  strings.TrimSpace,
-			"Contains":   strings.Contains,
-			"HasPrefix":  strings.HasPrefix,
-			"HasSuffix":  strings.HasSuffix,
-			"Replace":    strings.Replace,
-			"ReplaceAll": strings.ReplaceAll,
-			"Split":      strings.Split,
-			"Join":       strings.Join,
-			"Repeat":     strings.Repeat,
-		},
-		// strconv 包函数
-		"strconv": map[string]any{
-			"Atoi":     strconv.Atoi,
-			"Itoa":     strconv.Itoa,
-			"ParseInt": strconv.ParseInt,
-			"FormatInt": strconv.FormatInt,
-		},
-		// time 包函数
-		"time": map[string]any{
-			"Now": time.Now,
-		},
-		// 常用的全局函数
-		"len": func(v any) int {
-			switch val := v.(type) {
-			case string:
-				return len(val)
-			case []any:
-				return len(val)
-			case []string:
-				return len(val)
-			case []int:
-				return len(val)
-			case map[string]any:
-				return len(val)
-			default:
-				return 0
-			}
-		},
+// rangeFunc 生成整数序列，用法与 Python 的 range 相同：
+// range(n) 生成 0..n-1，range(start, end) 生成 start..end-1，range(start, end, step) 按步长生成
+func rangeFunc(args ...int) ([]int, error) {
+	start, end, step := 0, 0, 1
+	switch len(args) {
+	case 1:
+		end = args[0]
+	case 2:
+		start, end = args[0], args[1]
+	case 3:
+		start, end, step = args[0], args[1], args[2]
+	default:
+		return nil, fmt.Errorf("range expects 1 to 3 arguments, got %d", len(args))
+	}
+	if step == 0 {
+		return nil, fmt.Errorf("range step cannot be zero")
 	}
-	// 合并用户上下文
-	for k, v := range ctx {
-		env[k] = v
+
+	out := []int{}
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		out = append(out, i)
 	}
+	return out, nil
+}
 
-	program, err := expr.Compile(code, expr.Env(env), expr.AllowUndefinedVariables())
+// builtins 表达式中可用的内置函数和 Go 标准库函数
+// 编译时作为类型信息使用，渲染时由 withBuiltins 放入作用域；调用方上下文中的同名变量优先
+var builtins = map[string]any{
+	"nullCoalesce": nullCoalesceFunc,
+	"safeGet":      safeGet,
+	"safeIndex":    safeIndex,
+	// strings 包函数
+	"strings": map[string]any{
+		"ToUpper":    strings.ToUpper,
+		"ToLower":    strings.ToLower,
+		"TrimSpace":  strings.TrimSpace,
+		"Contains":   strings.Contains,
+		"HasPrefix":  strings.HasPrefix,
+		"HasSuffix":  strings.HasSuffix,
+		"Replace":    strings.Replace,
+		"ReplaceAll": strings.ReplaceAll,
+		"Split":      strings.Split,
+		"Join":       strings.Join,
+		"Repeat":     strings.Repeat,
+	},
+	// strconv 包函数
+	"strconv": map[string]any{
+		"Atoi":      strconv.Atoi,
+		"Itoa":      strconv.Itoa,
+		"ParseInt":  strconv.ParseInt,
+		"FormatInt": strconv.FormatInt,
+	},
+	// time 包函数
+	"time": map[string]any{
+		"Now": time.Now,
+	},
+	// 常用的全局函数
+	"range": rangeFunc,
+	"len": func(v any) int {
+		switch val := v.(type) {
+		case string:
+			return len(val)
+		case []any:
+			return len(val)
+		case []string:
+			return len(val)
+		case []int:
+			return len(val)
+		case map[string]any:
+			return len(val)
+		default:
+			return 0
+		}
+	},
+}
+
+// withBuiltins 将内置函数加入作用域，已有的同名变量保持不变
+func withBuiltins(scope map[string]any) map[string]any {
+	for k, v := range builtins {
+		if _, exists := scope[k]; !exists {
+			scope[k] = v
+		}
+	}
+	return scope
+}
+
+// program 预编译的表达式
+// 编译错误不会在解析时返回，而是在渲染到该表达式时报告，与每次渲染时编译的行为一致
+type program struct {
+	code string      // 表达式源码
+	src  string      // 预处理后实际编译的源码
+	prog *vm.Program // 编译结果，编译失败时为 nil
+	err  error       // 编译错误
+
+	// shadows 表达式中与内置函数同名的标识符，按名称排序；
+	// 渲染时其中由调用方提供的名称按模板变量处理，见 inScope
+	shadows  []string
+	variants sync.Map // 被覆盖的名称组合（逗号分隔）到 *program 的缓存
+
+	loopOnce sync.Once
+	loop     *program // 循环上下文中使用的版本：嵌套属性访问替换为 safeGet，首次使用时编译
+}
+
+// compileProgram 编译表达式
+// 编译时只知道内置函数的类型，模板变量在渲染时从作用域中按名称读取
+func compileProgram(code string) *program {
+	src := preprocessNullCoalescing(code)
+	p := &program{code: code, src: src}
+	p.prog, p.shadows, p.err = compileShadowed(src, nil)
+	return p
+}
+
+// compileShadowed 编译预处理后的表达式，shadowed 中的名称不使用同名的内置函数，按模板变量处理
+// 同时返回表达式中与内置函数同名的标识符
+func compileShadowed(src string, shadowed []string) (*vm.Program, []string, error) {
+	env, opts, shadows := compileEnv(src, shadowed)
+	opts = append(opts, expr.Env(env), expr.AllowUndefinedVariables())
+	prog, err := expr.Compile(src, opts...)
+	return prog, shadows, err
+}
+
+// compileEnv 返回编译表达式使用的类型环境、编译选项和表达式中与内置函数同名的标识符
+// 作为普通值使用（不是被调用的函数，也不是成员访问的对象）的标识符和 shadowed 中的名称都按模板变量处理：
+// 从类型环境中去掉同名的内置函数，并禁用 expr 的同名内置函数，
+// 这样上下文中名为 count、max、time 等的变量与每次渲染时编译一样可以正常使用
+func compileEnv(code string, shadowed []string) (map[string]any, []expr.Option, []string) {
+	tree, err := exprparser.Parse(code)
 	if err != nil {
-		return nil, err
+		// 语法错误由 expr.Compile 报告
+		return builtins, nil, nil
 	}
-	
-	result, err := expr.Run(program, env)
+	v := &identVisitor{excluded: map[*ast.IdentifierNode]bool{}}
+	ast.Walk(&tree.Node, v)
+
+	variables := append([]string(nil), shadowed...)
+	seen := map[string]bool{}
+	var shadows []string
+	for _, ident := range v.idents {
+		name := ident.Value
+		if !v.excluded[ident] {
+			variables = append(variables, name)
+		}
+		if !seen[name] && isBuiltinName(name) {
+			shadows = append(shadows, name)
+		}
+		seen[name] = true
+	}
+	for _, name := range v.builtins {
+		if !seen[name] {
+			shadows = append(shadows, name)
+		}
+		seen[name] = true
+	}
+	sort.Strings(shadows)
+
+	env := builtins
+	copied := false
+	var opts []expr.Option
+	for _, name := range variables {
+		opts = append(opts, expr.DisableBuiltin(name))
+		if _, ok := env[name]; ok {
+			if !copied {
+				copied = true
+				env = make(map[string]any, len(builtins))
+				for k, fn := range builtins {
+					env[k] = fn
+				}
+			}
+			delete(env, name)
+		}
+	}
+	return env, opts, shadows
+}
+
+// isBuiltinName 判断名称是否与 expr 或模板的内置函数同名，预处理使用的内部函数除外
+func isBuiltinName(name string) bool {
+	switch name {
+	case "nullCoalesce", "safeGet", "safeIndex":
+		return false
+	}
+	if _, ok := builtin.Index[name]; ok {
+		return true
+	}
+	_, ok := builtins[name]
+	return ok
+}
+
+// isBuiltinValue 判断作用域中的值是否就是 withBuiltins 放入的内置函数
+func isBuiltinValue(name string, v any) bool {
+	b, ok := builtins[name]
+	if !ok {
+		return false
+	}
+	bv, vv := reflect.ValueOf(b), reflect.ValueOf(v)
+	return bv.Kind() == vv.Kind() && bv.Pointer() == vv.Pointer()
+}
+
+// inScope 返回适用于当前作用域的版本
+// 表达式中与内置函数同名的标识符由调用方提供（上下文变量、函数或宏）时，
+// 使用把这些名称作为模板变量编译的版本，例如 ${ date.year }、${ upper(x) }；每种组合只编译一次
+func (p *program) inScope(ctx map[string]any) *program {
+	var shadowed []string
+	for _, name := range p.shadows {
+		if v, ok := ctx[name]; ok && !isBuiltinValue(name, v) {
+			shadowed = append(shadowed, name)
+		}
+	}
+	if len(shadowed) == 0 {
+		return p
+	}
+	key := strings.Join(shadowed, ",")
+	if v, ok := p.variants.Load(key); ok {
+		return v.(*program)
+	}
+	variant := &program{code: p.code, src: p.src}
+	variant.prog, _, variant.err = compileShadowed(p.src, shadowed)
+	v, _ := p.variants.LoadOrStore(key, variant)
+	return v.(*program)
+}
+
+// identVisitor 收集表达式中的标识符和调用的 expr 内置函数，并记录作为函数调用或成员访问对象的标识符
+type identVisitor struct {
+	idents   []*ast.IdentifierNode
+	excluded map[*ast.IdentifierNode]bool
+	builtins []string // 调用的 expr 内置函数
+}
+
+// Visit 实现 ast.Visitor
+func (v *identVisitor) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		v.idents = append(v.idents, n)
+	case *ast.BuiltinNode:
+		// 解析时 expr 的内置函数调用不是标识符，只记录名称
+		v.builtins = append(v.builtins, n.Name)
+	case *ast.CallNode:
+		if ident, ok := n.Callee.(*ast.IdentifierNode); ok {
+			v.excluded[ident] = true
+		}
+	case *ast.MemberNode:
+		if ident, ok := n.Node.(*ast.IdentifierNode); ok {
+			v.excluded[ident] = true
+		}
+	}
+}
+
+// inContext 返回适用于当前上下文的版本，循环上下文中使用安全的嵌套属性访问
+func (p *program) inContext(ctx map[string]any) *program {
+	if !isInLoopContext(ctx) {
+		return p
+	}
+	p.loopOnce.Do(func() {
+		p.loop = compileProgram(preprocessNestedAccess(p.code))
+	})
+	return p.loop
+}
+
+// eval 在作用域中计算表达式的值，作用域中需要包含内置函数（见 withBuiltins）
+func (p *program) eval(ctx map[string]any) (any, error) {
+	p = p.inScope(ctx)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	result, err := expr.Run(p.prog, ctx)
 	if err != nil {
 		// 对于数组越界访问，返回nil而不是错误
 		if strings.Contains(err.Error(), "index out of range") {
@@ -180,54 +393,54 @@ func evalExpr(code string, ctx map[string]any) (any, error) {
 		}
 		return nil, err
 	}
-	
+
 	// 检查除零错误 - 检查是否为无穷大或NaN
 	if f, ok := result.(float64); ok {
 		if math.IsInf(f, 0) || math.IsNaN(f) {
 			return nil, fmt.Errorf("division by zero")
 		}
 	}
-	
+
 	return result, nil
 }
 
-// evalBool 计算布尔表达式的值，支持真值判断
-func evalBool(code string, ctx map[string]any) (bool, error) {
-	v, err := evalExpr(code, ctx)
+// evalBool 计算表达式的值并进行真值判断
+func (p *program) evalBool(ctx map[string]any) (bool, error) {
+	v, err := p.eval(ctx)
 	if err != nil {
 		return false, err
 	}
-	
-	// 如果是布尔值，直接返回
-	if b, ok := v.(bool); ok {
-		return b, nil
-	}
-	
-	// 真值判断：nil、0、空字符串、空数组、空map为假，其他为真
+	return truthy(v), nil
+}
+
+// truthy 真值判断：nil、0、空字符串、空数组、空map为假，其他为真
+func truthy(v any) bool {
 	switch val := v.(type) {
+	case bool:
+		return val
 	case nil:
-		return false, nil
+		return false
 	case string:
-		return val != "", nil
+		return val != ""
 	case int:
-		return val != 0, nil
+		return val != 0
 	case int64:
-		return val != 0, nil
+		return val != 0
 	case float64:
-		return val != 0, nil
+		return val != 0
 	case []any:
-		return len(val) > 0, nil
+		return len(val) > 0
 	case []string:
-		return len(val) > 0, nil
+		return len(val) > 0
 	case []int:
-		return len(val) > 0, nil
+		return len(val) > 0
 	case []map[string]any:
-		return len(val) > 0, nil
+		return len(val) > 0
 	case map[string]any:
-		return len(val) > 0, nil
+		return len(val) > 0
 	default:
 		// 其他类型默认为真
-		return true, nil
+		return true
 	}
 }
 
@@ -241,8 +454,7 @@ func isInLoopContext(ctx map[string]any) bool {
 // preprocessNestedAccess 预处理嵌套属性访问，将其转换为safeGet调用
 func preprocessNestedAccess(code string) string {
 	// 匹配 obj.prop.subprop 形式的嵌套属性访问
-	nestedPropRe := regexp.MustCompile(`(\w+)\.(\w+(?:\.\w+)*)`)
-	return nestedPropRe.ReplaceAllStringFunc(code, func(match string) string {
+	return reNestedProp.ReplaceAllStringFunc(code, func(match string) string {
 		// 跳过已经是函数调用的情况
 		if strings.Contains(match, "(") {
 			return match
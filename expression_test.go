@@ -20,25 +20,25 @@ func TestExpressionCalculation(t *testing.T) {
 			name:     "基本数学运算 - 加法",
 			template: "Result: ${10 + 5}",
 			context:  map[string]any{},
-			expected: "Result: 15\n",
+			expected: "Result: 15",
 		},
 		{
 			name:     "基本数学运算 - 减法",
 			template: "Result: ${20 - 8}",
 			context:  map[string]any{},
-			expected: "Result: 12\n",
+			expected: "Result: 12",
 		},
 		{
 			name:     "基本数学运算 - 乘法",
 			template: "Result: ${6 * 7}",
 			context:  map[string]any{},
-			expected: "Result: 42\n",
+			expected: "Result: 42",
 		},
 		{
 			name:     "基本数学运算 - 除法",
 			template: "Result: ${100 / 4}",
 			context:  map[string]any{},
-			expected: "Result: 25\n",
+			expected: "Result: 25",
 		},
 		{
 			name:     "变量参与计算 - 乘法",
@@ -47,7 +47,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"price":    10.5,
 				"quantity": 3,
 			},
-			expected: "total: 31.5\n",
+			expected: "total: 31.5",
 		},
 		{
 			name:     "多步计算 - 总价和折扣",
@@ -57,7 +57,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"quantity": 2,
 				"total":    200, // 预先计算的总价
 			},
-			expected: "total: 200\ndiscount: 20\n",
+			expected: "total: 200\ndiscount: 20",
 		},
 		{
 			name:     "复杂表达式 - 含税价格计算",
@@ -66,7 +66,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"price":    50,
 				"quantity": 2,
 			},
-			expected: "subtotal: 100\ntax: 8\ntotal: 108\n",
+			expected: "subtotal: 100\ntax: 8\ntotal: 108",
 		},
 		{
 			name:     "字符串拼接表达式",
@@ -75,7 +75,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"firstName": "张",
 				"lastName":  "三",
 			},
-			expected: "fullName: 张 三\n",
+			expected: "fullName: 张 三",
 		},
 		{
 			name:     "条件表达式 - 三元运算符",
@@ -83,7 +83,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"age": 25,
 			},
-			expected: "status: adult\n",
+			expected: "status: adult",
 		},
 		{
 			name:     "数组长度计算",
@@ -91,7 +91,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"items": []string{"apple", "banana", "cherry"},
 			},
-			expected: "itemCount: 3\n",
+			expected: "itemCount: 3",
 		},
 		{
 			name:     "嵌套对象属性计算",
@@ -102,7 +102,7 @@ func TestExpressionCalculation(t *testing.T) {
 					"height": 5,
 				},
 			},
-			expected: "area: 50\n",
+			expected: "area: 50",
 		},
 		{
 			name:     "数组元素计算",
@@ -110,7 +110,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"numbers": []any{10, 20, 30},
 			},
-			expected: "sum: 60\n",
+			expected: "sum: 60",
 		},
 		{
 			name:     "百分比计算",
@@ -119,7 +119,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"current": 75,
 				"total":   100,
 			},
-			expected: "percentage: 75%\n",
+			expected: "percentage: 75%",
 		},
 		{
 			name:     "浮点数精度计算",
@@ -127,7 +127,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"price": 99.99,
 			},
-			expected: "result: 114.98849999999999\n",
+			expected: "result: 114.98849999999999",
 		},
 		{
 			name:     "布尔逻辑运算",
@@ -136,7 +136,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"isLoggedIn":    true,
 				"hasPermission": true,
 			},
-			expected: "canAccess: true\n",
+			expected: "canAccess: true",
 		},
 		{
 			name:     "Go标准库 - strings.ToUpper",
@@ -144,7 +144,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"appName": "hello-world",
 			},
-			expected: "upperName: HELLO-WORLD\n",
+			expected: "upperName: HELLO-WORLD",
 		},
 		{
 			name:     "Go标准库 - strings.ToLower",
@@ -152,7 +152,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"appName": "HELLO-WORLD",
 			},
-			expected: "lowerName: hello-world\n",
+			expected: "lowerName: hello-world",
 		},
 		{
 			name:     "Go标准库 - strings.Contains",
@@ -161,7 +161,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"text":    "Hello World",
 				"keyword": "World",
 			},
-			expected: "hasKeyword: true\n",
+			expected: "hasKeyword: true",
 		},
 		{
 			name:     "Go标准库 - strings.Replace",
@@ -171,7 +171,7 @@ func TestExpressionCalculation(t *testing.T) {
 				"old":  "hello",
 				"new":  "hi",
 			},
-			expected: "replaced: hi world hello\n",
+			expected: "replaced: hi world hello",
 		},
 		{
 			name:     "Go标准库 - strings.Split和len组合",
@@ -179,7 +179,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"sentence": "hello world from go",
 			},
-			expected: "wordCount: 4\n",
+			expected: "wordCount: 4",
 		},
 		{
 			name:     "Go标准库 - strconv.Itoa",
@@ -187,7 +187,7 @@ func TestExpressionCalculation(t *testing.T) {
 			context: map[string]any{
 				"number": 42,
 			},
-			expected: "numberStr: 42\n",
+			expected: "numberStr: 42",
 		},
 	}
 
@@ -227,7 +227,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"appName": "my-awesome-app",
 			},
-			expected: "upperName: MY-AWESOME-APP\n",
+			expected: "upperName: MY-AWESOME-APP",
 		},
 		{
 			name:     "strings.ToLower - 转换为小写",
@@ -235,7 +235,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"appName": "MY-AWESOME-APP",
 			},
-			expected: "lowerName: my-awesome-app\n",
+			expected: "lowerName: my-awesome-app",
 		},
 		{
 			name:     "strings.TrimSpace - 去除空格",
@@ -243,7 +243,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"text": "  hello world  ",
 			},
-			expected: "trimmed: 'hello world'\n",
+			expected: "trimmed: 'hello world'",
 		},
 		{
 			name:     "strings.Contains - 检查包含",
@@ -252,7 +252,7 @@ func TestGoStandardLibrary(t *testing.T) {
 				"text":    "Hello Go Programming",
 				"keyword": "Go",
 			},
-			expected: "contains: true\n",
+			expected: "contains: true",
 		},
 		{
 			name:     "strings.HasPrefix - 检查前缀",
@@ -261,7 +261,7 @@ func TestGoStandardLibrary(t *testing.T) {
 				"filename": "config.yaml",
 				"prefix":   "config",
 			},
-			expected: "hasPrefix: true\n",
+			expected: "hasPrefix: true",
 		},
 		{
 			name:     "strings.HasSuffix - 检查后缀",
@@ -269,7 +269,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"filename": "main.go",
 			},
-			expected: "hasGoExt: true\n",
+			expected: "hasGoExt: true",
 		},
 		{
 			name:     "strings.ReplaceAll - 替换所有",
@@ -279,7 +279,7 @@ func TestGoStandardLibrary(t *testing.T) {
 				"old":  "hello",
 				"new":  "hi",
 			},
-			expected: "replaced: hi world hi universe\n",
+			expected: "replaced: hi world hi universe",
 		},
 		{
 			name:     "strings.Split - 分割字符串",
@@ -287,7 +287,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"csv": "apple,banana,cherry",
 			},
-			expected: "parts: [apple banana cherry]\n",
+			expected: "parts: [apple banana cherry]",
 		},
 		{
 			name:     "strings.Join - 连接字符串",
@@ -295,7 +295,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"parts": []string{"apple", "banana", "cherry"},
 			},
-			expected: "joined: apple | banana | cherry\n",
+			expected: "joined: apple | banana | cherry",
 		},
 		{
 			name:     "strings.Repeat - 重复字符串",
@@ -304,7 +304,7 @@ func TestGoStandardLibrary(t *testing.T) {
 				"char":  "*",
 				"count": 5,
 			},
-			expected: "repeated: *****\n",
+			expected: "repeated: *****",
 		},
 		{
 			name:     "strconv.Itoa - 整数转字符串",
@@ -312,7 +312,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"number": 12345,
 			},
-			expected: "numberStr: 12345\n",
+			expected: "numberStr: 12345",
 		},
 		{
 			name:     "组合使用 - 格式化名称",
@@ -320,7 +320,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"name": "hello world app",
 			},
-			expected: "formattedName: HELLO_WORLD_APP\n",
+			expected: "formattedName: HELLO_WORLD_APP",
 		},
 		{
 			name:     "组合使用 - 文件名处理",
@@ -328,7 +328,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"filename": "MAIN.GO",
 			},
-			expected: "isGoFile: true\n",
+			expected: "isGoFile: true",
 		},
 		{
 			name:     "组合使用 - 统计单词数",
@@ -336,7 +336,7 @@ func TestGoStandardLibrary(t *testing.T) {
 			context: map[string]any{
 				"text": "  hello world from golang  ",
 			},
-			expected: "wordCount: 4\n",
+			expected: "wordCount: 4",
 		},
 	}
 
@@ -376,7 +376,7 @@ func TestArrayOperations(t *testing.T) {
 			context: map[string]any{
 				"items": []any{"apple", "banana", "cherry"},
 			},
-			expected: "first: apple\nsecond: banana\nthird: cherry\n",
+			expected: "first: apple\nsecond: banana\nthird: cherry",
 		},
 		{
 			name:     "数组角标访问 - 数字数组",
@@ -384,7 +384,7 @@ func TestArrayOperations(t *testing.T) {
 			context: map[string]any{
 				"numbers": []any{10, 20, 30},
 			},
-			expected: "first: 10\nlast: 30\n",
+			expected: "first: 10\nlast: 30",
 		},
 		{
 			name:     "对象数组角标访问 - 容器名称",
@@ -395,7 +395,7 @@ func TestArrayOperations(t *testing.T) {
 					map[string]any{"name": "db", "image": "mysql"},
 				},
 			},
-			expected: "firstContainer: web\nsecondContainer: db\n",
+			expected: "firstContainer: web\nsecondContainer: db",
 		},
 		{
 			name:     "对象数组角标访问 - 嵌套属性",
@@ -414,7 +414,7 @@ func TestArrayOperations(t *testing.T) {
 					},
 				},
 			},
-			expected: "firstImage: nginx:1.21\nfirstPort: 80\n",
+			expected: "firstImage: nginx:1.21\nfirstPort: 80",
 		},
 		{
 			name:     "数组长度和角标结合",
@@ -422,7 +422,7 @@ func TestArrayOperations(t *testing.T) {
 			context: map[string]any{
 				"items": []any{"first", "middle", "last"},
 			},
-			expected: "count: 3\nlast: last\n",
+			expected: "count: 3\nlast: last",
 		},
 		{
 			name:     "多维数组访问",
@@ -434,7 +434,7 @@ func TestArrayOperations(t *testing.T) {
 					[]any{7, 8, 9},
 				},
 			},
-			expected: "matrix00: 1\nmatrix11: 5\n",
+			expected: "matrix00: 1\nmatrix11: 5",
 		},
 		{
 			name:     "数组角标计算",
@@ -443,7 +443,7 @@ func TestArrayOperations(t *testing.T) {
 				"items": []any{"zero", "one", "two", "three"},
 				"index": 1,
 			},
-			expected: "item: one\nnextItem: two\n",
+			expected: "item: one\nnextItem: two",
 		},
 		{
 			name:     "用户数组访问",
@@ -462,7 +462,7 @@ func TestArrayOperations(t *testing.T) {
 					},
 				},
 			},
-			expected: "firstUser: 张三\nfirstUserEmail: zhangsan@example.com\n",
+			expected: "firstUser: 张三\nfirstUserEmail: zhangsan@example.com",
 		},
 		{
 			name:     "配置数组访问",
@@ -481,7 +481,7 @@ func TestArrayOperations(t *testing.T) {
 					},
 				},
 			},
-			expected: "dbHost: localhost\ndbPort: 5432\n",
+			expected: "dbHost: localhost\ndbPort: 5432",
 		},
 		{
 			name:     "环境变量数组访问",
@@ -492,7 +492,7 @@ func TestArrayOperations(t *testing.T) {
 					map[string]any{"name": "PORT", "value": "3000"},
 				},
 			},
-			expected: "firstEnv: NODE_ENV=production\n",
+			expected: "firstEnv: NODE_ENV=production",
 		},
 		{
 			name:     "数组角标与字符串操作结合",
@@ -503,7 +503,7 @@ func TestArrayOperations(t *testing.T) {
 					map[string]any{"name": "bob"},
 				},
 			},
-			expected: "upperFirstName: ALICE\n",
+			expected: "upperFirstName: ALICE",
 		},
 		{
 			name:     "数组角标与数学运算结合",
@@ -511,7 +511,7 @@ func TestArrayOperations(t *testing.T) {
 			context: map[string]any{
 				"prices": []any{10.5, 20.0, 15.75},
 			},
-			expected: "total: 46.25\n",
+			expected: "total: 46.25",
 		},
 		{
 			name:     "安全数组访问 - 越界返回空",
@@ -519,7 +519,7 @@ func TestArrayOperations(t *testing.T) {
 			context: map[string]any{
 				"items": []any{"only-one"},
 			},
-			expected: "exists: \nnotExists: \n",
+			expected: "exists: \nnotExists: ",
 		},
 		{
 			name:     "复杂对象数组访问",
@@ -540,7 +540,7 @@ func TestArrayOperations(t *testing.T) {
 					},
 				},
 			},
-			expected: "serviceName: web-service\nservicePort: 80\n",
+			expected: "serviceName: web-service\nservicePort: 80",
 		},
 	}
 
@@ -585,7 +585,7 @@ func TestComplexExpressions(t *testing.T) {
 				"itemTotal": 77.97, // 预计算值
 				"shipping":  10,     // 预计算值
 			},
-			expected: "itemTotal: 77.97\nshipping: 10\nfinalTotal: 87.97\n",
+			expected: "itemTotal: 77.97\nshipping: 10\nfinalTotal: 87.97",
 		},
 		{
 			name:     "员工薪资计算",
@@ -597,7 +597,7 @@ func TestComplexExpressions(t *testing.T) {
 				},
 				"bonus": 600, // 预计算值
 			},
-			expected: "baseSalary: 5000\nbonus: 600\ntotalSalary: 5600\n",
+			expected: "baseSalary: 5000\nbonus: 600\ntotalSalary: 5600",
 		},
 		{
 			name:     "几何计算 - 圆形面积",
@@ -607,7 +607,7 @@ func TestComplexExpressions(t *testing.T) {
 					"radius": 5,
 				},
 			},
-			expected: "radius: 5\narea: 78.53975\n",
+			expected: "radius: 5\narea: 78.53975",
 		},
 		{
 			name:     "时间计算 - 小时转分钟",
@@ -618,7 +618,7 @@ func TestComplexExpressions(t *testing.T) {
 					"minutes": 30,
 				},
 			},
-			expected: "hours: 2\nminutes: 150\n",
+			expected: "hours: 2\nminutes: 150",
 		},
 		{
 			name:     "数组统计计算",
@@ -626,7 +626,7 @@ func TestComplexExpressions(t *testing.T) {
 			context: map[string]any{
 				"scores": []int{85, 92, 78},
 			},
-			expected: "count: 3\naverage: 85\n",
+			expected: "count: 3\naverage: 85",
 		},
 	}
 
@@ -706,6 +706,112 @@ func TestExpressionErrorHandling(t *testing.T) {
 	}
 }
 
+// TestVariableShadowsBuiltin 测试与内置函数同名的上下文变量
+func TestVariableShadowsBuiltin(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "与expr内置函数同名",
+			template: "${count > 100 ? \"many\" : \"few\"} ${max}",
+			context:  map[string]any{"count": 150, "max": 3},
+			expected: "many 3",
+		},
+		{
+			name:     "与标准库命名空间同名",
+			template: "${time == \"t\"} ${strings}",
+			context:  map[string]any{"time": "t", "strings": "s"},
+			expected: "true s",
+		},
+		{
+			name:     "同一引擎中函数调用不受影响",
+			template: "${len(items)} ${strings.ToUpper(\"a\")}",
+			context:  map[string]any{"items": []int{1, 2}},
+			expected: "2 A",
+		},
+		{
+			name:     "与expr内置函数同名的对象成员访问",
+			template: "${date.year} ${type.name} ${max.value} ${duration[0]}",
+			context: map[string]any{
+				"date":     map[string]any{"year": 2024},
+				"type":     map[string]any{"name": "web"},
+				"max":      map[string]any{"value": 5},
+				"duration": []any{"30s"},
+			},
+			expected: "2024 web 5 30s",
+		},
+		{
+			name:     "与expr内置函数同名的上下文函数",
+			template: "${upper(\"a\")} ${now()} ${keys}",
+			context: map[string]any{
+				"upper": func(s string) string { return "U:" + s },
+				"now":   func() string { return "fixed" },
+				"keys":  "k",
+			},
+			expected: "U:a fixed k",
+		},
+		{
+			name:     "上下文中没有同名变量时使用内置函数",
+			template: "${upper(\"a\")} ${len(items)} ${max(1, 2)}",
+			context:  map[string]any{"items": []int{1}},
+			expected: "A 1 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestProgramCache 测试同一引擎中相同的表达式只编译一次
+func TestProgramCache(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	first, err := eng.ParseString("${price * quantity}")
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	second, err := eng.ParseString("total: ${price * quantity}")
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	progOf := func(tpl *Template) *program {
+		for _, n := range tpl.nodes {
+			if e, ok := n.(*exprNode); ok {
+				return e.prog
+			}
+		}
+		t.Fatalf("模板中没有表达式节点")
+		return nil
+	}
+	if progOf(first) != progOf(second) {
+		t.Errorf("相同的表达式被重复编译")
+	}
+	if New(loader).compile("price * quantity") == progOf(first) {
+		t.Errorf("不同引擎之间不应共享编译缓存")
+	}
+}
+
 // BenchmarkExpressionCalculation 表达式计算性能基准测试
 func BenchmarkExpressionCalculation(b *testing.B) {
 	loader := os.DirFS(".")
@@ -731,4 +837,53 @@ func BenchmarkExpressionCalculation(b *testing.B) {
 			b.Fatalf("渲染模板失败: %v", err)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// BenchmarkExpressionParseAndRender 每次迭代都解析并渲染，表达式命中引擎的编译缓存
+func BenchmarkExpressionParseAndRender(b *testing.B) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	template := "total: ${price * quantity}\ndiscount: ${total * 0.1}\nfinal: ${total - discount}"
+	context := map[string]any{
+		"price":    99.99,
+		"quantity": 3,
+		"total":    299.97,
+		"discount": 29.997,
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tpl, err := eng.ParseString(template)
+		if err != nil {
+			b.Fatalf("解析模板失败: %v", err)
+		}
+		if _, err := tpl.Render(context); err != nil {
+			b.Fatalf("渲染模板失败: %v", err)
+		}
+	}
+}
+
+// BenchmarkExpressionParseAndRenderUncached 每次迭代使用新引擎，包含编译表达式的开销
+func BenchmarkExpressionParseAndRenderUncached(b *testing.B) {
+	loader := os.DirFS(".")
+
+	template := "total: ${price * quantity}\ndiscount: ${total * 0.1}\nfinal: ${total - discount}"
+	context := map[string]any{
+		"price":    99.99,
+		"quantity": 3,
+		"total":    299.97,
+		"discount": 29.997,
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tpl, err := New(loader).ParseString(template)
+		if err != nil {
+			b.Fatalf("解析模板失败: %v", err)
+		}
+		if _, err := tpl.Render(context); err != nil {
+			b.Fatalf("渲染模板失败: %v", err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// setupExtendsTestFiles 创建模板继承测试用的父模板
+func setupExtendsTestFiles(t *testing.T) {
+	files := map[string]string{
+		"test_base.tpl": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: ${name}
+#block labels
+  labels:
+    app: ${name}
+#end
+spec:
+#block spec
+  replicas: 1
+#end`,
+		"test_mid.tpl": `#extends "test_base.tpl"
+#block labels
+${ super() }
+    tier: ${tier ?? "backend"}
+#end`,
+		"test_cycle_a.tpl": `#extends "test_cycle_b.tpl"`,
+		"test_cycle_b.tpl": `#extends "test_cycle_a.tpl"`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("创建测试文件失败: %v", err)
+		}
+		t.Cleanup(func() { os.Remove(name) })
+	}
+}
+
+// TestTemplateInheritance 测试 #extends 和 #block
+func TestTemplateInheritance(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+	setupExtendsTestFiles(t)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "不覆盖任何区域",
+			template: `#extends "test_base.tpl"`,
+			context:  map[string]any{"name": "api"},
+			expected: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  labels:\n    app: api\nspec:\n  replicas: 1\n",
+		},
+		{
+			name: "覆盖区域",
+			template: `#extends "test_base.tpl"
+#block spec
+  replicas: ${replicas}
+#end`,
+			context:  map[string]any{"name": "api", "replicas": 3},
+			expected: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  labels:\n    app: api\nspec:\n  replicas: 3\n",
+		},
+		{
+			name: "通过super引用父模板内容",
+			template: `#extends "test_base.tpl"
+#block labels
+${ super() }
+    tier: frontend
+#end`,
+			context:  map[string]any{"name": "web"},
+			expected: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  labels:\n    app: web\n    tier: frontend\nspec:\n  replicas: 1\n",
+		},
+		{
+			name: "子模板顶层的set在父模板中可见",
+			template: `#extends "test_base.tpl"
+#set name = service + "-svc"
+这一行在区域之外，会被忽略`,
+			context:  map[string]any{"service": "cart"},
+			expected: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: cart-svc\n  labels:\n    app: cart-svc\nspec:\n  replicas: 1\n",
+		},
+		{
+			name: "多级继承",
+			template: `#extends "test_mid.tpl"
+#block labels
+${ super() }
+    team: ${team}
+#end
+#block spec
+  replicas: 2
+#end`,
+			context:  map[string]any{"name": "web", "team": "shop"},
+			expected: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  labels:\n    app: web\n    tier: backend\n    team: shop\nspec:\n  replicas: 2\n",
+		},
+		{
+			name: "没有父模板时区域按原样渲染",
+			template: `#block greeting
+hello ${name}
+#end`,
+			context:  map[string]any{"name": "world"},
+			expected: "hello world\n",
+		},
+		{
+			name: "覆盖中使用宏",
+			template: `#extends "test_base.tpl"
+#define replicas(n)
+  replicas: ${n}
+#end
+#block spec
+#call replicas(5)
+#end`,
+			context:  map[string]any{"name": "api"},
+			expected: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  labels:\n    app: api\nspec:\n  replicas: 5\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestTemplateInheritanceErrors 测试模板继承的错误
+func TestTemplateInheritanceErrors(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+	setupExtendsTestFiles(t)
+
+	tests := []struct {
+		name       string
+		template   string
+		parseError bool
+		contains   string
+	}{
+		{
+			name:       "重复的extends",
+			template:   "#extends \"test_base.tpl\"\n#extends \"test_mid.tpl\"",
+			parseError: true,
+			contains:   `line 2: #extends: template already extends "test_base.tpl"`,
+		},
+		{
+			name:       "块内的extends",
+			template:   "#if true\n#extends \"test_base.tpl\"\n#end",
+			parseError: true,
+			contains:   "line 2: #extends must be at the top level of a template",
+		},
+		{
+			name:       "重复的区域",
+			template:   "#block a\n#end\n#block a\n#end",
+			parseError: true,
+			contains:   `line 3: #block: block "a" already defined`,
+		},
+		{
+			name:       "未闭合的区域",
+			template:   "#block a\nx",
+			parseError: true,
+			contains:   "line 1: unterminated #block: missing #end",
+		},
+		{
+			name:     "父模板不存在",
+			template: `#extends "missing_base.tpl"`,
+			contains: `line 1: #extends "missing_base.tpl"`,
+		},
+		{
+			name:     "循环继承",
+			template: `#extends "test_cycle_a.tpl"`,
+			contains: "#extends cycle: test_cycle_a.tpl -> test_cycle_b.tpl -> test_cycle_a.tpl",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if tt.parseError {
+				if err == nil || !strings.Contains(err.Error(), tt.contains) {
+					t.Fatalf("期望解析错误包含 %q, 实际: %v", tt.contains, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			_, err = tpl.Render(map[string]any{})
+			if err == nil || !strings.Contains(err.Error(), tt.contains) {
+				t.Errorf("期望渲染错误包含 %q, 实际: %v", tt.contains, err)
+			}
+		})
+	}
+}
+
+// TestTemplateInheritanceCached 测试父模板只读取一次，渲染和变量分析都使用缓存的模板
+func TestTemplateInheritanceCached(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	if err := os.WriteFile("test_cached_base.tpl", []byte("v1 ${name}\n#block body\n#end"), 0644); err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	t.Cleanup(func() { os.Remove("test_cached_base.tpl") })
+
+	tpl, err := eng.ParseString("#extends \"test_cached_base.tpl\"\n#block body\nbody\n#end")
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	ctx := map[string]any{"name": "a"}
+	result, err := tpl.Render(ctx)
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "v1 a\nbody\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+
+	// 文件修改后同一引擎仍使用缓存的父模板
+	if err := os.WriteFile("test_cached_base.tpl", []byte("v2 ${title}\n#block body\n#end"), 0644); err != nil {
+		t.Fatalf("修改测试文件失败: %v", err)
+	}
+	result, err = tpl.Render(ctx)
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "v1 a\nbody\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+	vars, err := tpl.Variables()
+	if err != nil {
+		t.Fatalf("分析变量失败: %v", err)
+	}
+	if len(vars) != 1 || vars[0].Path != "name" {
+		t.Errorf("期望只引用 name, 实际: %+v", vars)
+	}
+
+	// 新的引擎重新读取文件
+	tpl, err = New(loader).ParseString("#extends \"test_cached_base.tpl\"")
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err = tpl.Render(map[string]any{"title": "b"})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "v2 b\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+}
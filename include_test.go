@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -26,7 +28,7 @@ func TestIncludeStatements(t *testing.T) {
 #include "test_header.tpl"
 After include`,
 			context:  map[string]any{"title": "Test Page"},
-			expected: "Before include\n<h1>Test Page</h1>\nAfter include\n",
+			expected: "Before include\n<h1>Test Page</h1>\nAfter include",
 		},
 		{
 			name:     "多个文件包含",
@@ -37,7 +39,7 @@ After include`,
 				"title": "Multi Include",
 				"year":  2024,
 			},
-			expected: "<h1>Multi Include</h1>\n<main>Content here</main>\n<footer>Copyright 2024</footer>\n",
+			expected: "<h1>Multi Include</h1>\n<main>Content here</main>\n<footer>Copyright 2024</footer>",
 		},
 		{
 			name:     "包含文件中的变量插值",
@@ -49,7 +51,7 @@ After include`,
 					"age":   30,
 				},
 			},
-			expected: "<div class=\"user-card\">\n  <h3>张三</h3>\n  <p>Email: zhangsan@example.com</p>\n  <p>Age: 30</p>\n</div>\n",
+			expected: "<div class=\"user-card\">\n  <h3>张三</h3>\n  <p>Email: zhangsan@example.com</p>\n  <p>Age: 30</p>\n</div>",
 		},
 		{
 			name:     "包含文件中的条件语句",
@@ -66,7 +68,7 @@ After include`,
 			context: map[string]any{
 				"items": []string{"Apple", "Banana", "Cherry"},
 			},
-			expected: "<ul>\n<li>Apple</li>\n<li>Banana</li>\n<li>Cherry</li>\n</ul>\n",
+			expected: "<ul>\n<li>Apple</li>\n<li>Banana</li>\n<li>Cherry</li>\n</ul>",
 		},
 		{
 			name:     "嵌套包含文件",
@@ -75,7 +77,7 @@ After include`,
 				"pageTitle": "Nested Test",
 				"content":   "This is nested content",
 			},
-			expected: "<html>\n<head><title>Nested Test</title></head>\n<body>This is nested content</body>\n</html>\n",
+			expected: "<html>\n<head><title>Nested Test</title></head>\n<body>This is nested content</body>\n</html>",
 		},
 		{
 			name:     "包含文件路径中的变量",
@@ -84,7 +86,7 @@ After include`,
 			context: map[string]any{
 				"message": "Hello from dynamic template!",
 			},
-			expected: "Dynamic include test:\nHello from dynamic template!\n",
+			expected: "Dynamic include test:\nHello from dynamic template!",
 		},
 	}
 
@@ -135,7 +137,7 @@ func TestIncludeEdgeCases(t *testing.T) {
 #include "test_empty.tpl"
 After`,
 			context:  map[string]any{},
-			expected: "Before\n\nAfter\n",
+			expected: "Before\n\nAfter",
 		},
 		{
 			name:     "包含只有空白字符的文件",
@@ -143,13 +145,13 @@ After`,
 #include "test_whitespace.tpl"
 After`,
 			context:  map[string]any{},
-			expected: "Before\n   \n\t\nAfter\n",
+			expected: "Before\n   \n\t\nAfter",
 		},
 		{
-			name:     "包含文件中有语法错误",
-			template: `#include "test_syntax_error.tpl"`,
-			context:  map[string]any{},
-			expected: "This has unclosed ${variable\n",
+			name:        "包含文件中有语法错误",
+			template:    `#include "test_syntax_error.tpl"`,
+			context:     map[string]any{},
+			shouldError: true,
 		},
 		{
 			name:     "多次包含同一文件",
@@ -157,7 +159,7 @@ After`,
 Middle content
 #include "test_header.tpl"`,
 			context:  map[string]any{"title": "Repeated"},
-			expected: "<h1>Repeated</h1>\nMiddle content\n<h1>Repeated</h1>\n",
+			expected: "<h1>Repeated</h1>\nMiddle content\n<h1>Repeated</h1>",
 		},
 	}
 
@@ -337,6 +339,540 @@ func TestIncludeWithComplexContext(t *testing.T) {
 	}
 }
 
+// TestIncludeWithParams 测试通过 with / only 向被包含模板传递参数
+func TestIncludeWithParams(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	err := os.WriteFile("test_container.tpl", []byte(`- name: ${name}
+  image: ${image}:${tag ?? "latest"}
+  namespace: ${namespace ?? "none"}`), 0644)
+	if err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	defer os.Remove("test_container.tpl")
+
+	tests := []struct {
+		name        string
+		template    string
+		context     map[string]any
+		expected    string
+		shouldError bool
+	}{
+		{
+			name: "with传入参数并继承上下文",
+			template: `#for c in containers
+#include "test_container.tpl" with { name: c.name, image: c.image }
+#end`,
+			context: map[string]any{
+				"namespace": "prod",
+				"containers": []any{
+					map[string]any{"name": "web", "image": "nginx"},
+					map[string]any{"name": "db", "image": "postgres"},
+				},
+			},
+			expected: "- name: web\n  image: nginx:latest\n  namespace: prod\n- name: db\n  image: postgres:latest\n  namespace: prod\n",
+		},
+		{
+			name:     "with参数覆盖同名变量",
+			template: `#include "test_container.tpl" with { name: "api", image: "app", namespace: "override" }`,
+			context:  map[string]any{"name": "outer", "namespace": "prod"},
+			expected: "- name: api\n  image: app:latest\n  namespace: override",
+		},
+		{
+			name:     "only只传入with中的参数",
+			template: `#include "test_container.tpl" with { name: "api", image: "app", tag: version } only`,
+			context:  map[string]any{"namespace": "prod", "version": "1.0"},
+			expected: "- name: api\n  image: app:1.0\n  namespace: none",
+		},
+		{
+			name:     "with参数为变量",
+			template: `#include "test_container.tpl" with spec`,
+			context: map[string]any{
+				"spec": map[string]any{"name": "cache", "image": "redis", "tag": "7"},
+			},
+			expected: "- name: cache\n  image: redis:7\n  namespace: none",
+		},
+		{
+			name:        "with参数不是map",
+			template:    `#include "test_container.tpl" with "oops"`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if tt.shouldError {
+				t.Errorf("期望出现错误，但成功执行了")
+				return
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestIncludeIndentation 测试被包含内容按照指令所在列缩进
+func TestIncludeIndentation(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	err := os.WriteFile("test_config_data.tpl", []byte(`app.properties: |
+  app.name=${appName}
+
+  app.debug=${debug ?? false}`), 0644)
+	if err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	defer os.Remove("test_config_data.tpl")
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "按指令列自动缩进",
+			template: `data:
+  #include "test_config_data.tpl"`,
+			context:  map[string]any{"appName": "demo"},
+			expected: "data:\n  app.properties: |\n    app.name=demo\n\n    app.debug=false",
+		},
+		{
+			name: "嵌套层级中的缩进",
+			template: `spec:
+  template:
+    #if true
+      #include "test_config_data.tpl"
+    #end`,
+			context:  map[string]any{"appName": "demo"},
+			expected: "spec:\n  template:\n      app.properties: |\n        app.name=demo\n\n        app.debug=false\n",
+		},
+		{
+			name: "indent指定缩进宽度",
+			template: `data:
+#include "test_config_data.tpl" indent 4`,
+			context:  map[string]any{"appName": "demo", "debug": true},
+			expected: "data:\n    app.properties: |\n      app.name=demo\n\n      app.debug=true",
+		},
+		{
+			name: "noindent关闭自动缩进",
+			template: `data:
+  #include "test_config_data.tpl" noindent`,
+			context:  map[string]any{"appName": "demo"},
+			expected: "data:\napp.properties: |\n  app.name=demo\n\n  app.debug=false",
+		},
+		{
+			name: "与with参数一起使用",
+			template: `data:
+  #include "test_config_data.tpl" with { appName: "other" } only indent 2`,
+			context:  map[string]any{"appName": "demo"},
+			expected: "data:\n  app.properties: |\n    app.name=other\n\n    app.debug=false",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestIncludeInvalidIndent 测试 indent N 的宽度过大时返回解析错误
+func TestIncludeInvalidIndent(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		errMsg   string
+	}{
+		{
+			name:     "超出整数范围",
+			template: "a\n#include \"x.tpl\" indent 99999999999999999999999",
+			errMsg:   "line 2: #include: invalid indent 99999999999999999999999, expected at most 256",
+		},
+		{
+			name:     "超过最大宽度",
+			template: "#include \"x.tpl\" indent 100000",
+			errMsg:   "line 1: #include: invalid indent 100000, expected at most 256",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := eng.ParseString(tt.template)
+			if err == nil || err.Error() != tt.errMsg {
+				t.Errorf("期望: %q, 实际: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+// setupIncludeChainTestFiles 创建循环包含和多层包含测试用的文件
+func setupIncludeChainTestFiles(t *testing.T) {
+	files := map[string]string{
+		"test_cycle_inc_a.tpl": "a\n#include \"test_cycle_inc_b.tpl\"",
+		"test_cycle_inc_b.tpl": "b\n#include \"test_cycle_inc_a.tpl\"",
+		"test_cycle_inc_self.tpl": `#if depth > 0
+#include "test_cycle_inc_self.tpl" with { depth: depth - 1 }
+#end`,
+		"test_cycle_macro_call.tpl": "#define m()\n#include \"test_cycle_macro_call.tpl\"\n#end\n#call m()",
+		"test_cycle_macro_expr.tpl": "#define m()\n#include \"test_cycle_macro_expr.tpl\"\n#end\n${ m() }",
+		"test_cycle_macro_with.tpl": "#define m()\n#include \"test_cycle_macro_use.tpl\" with {}\n#end\n${ m() }",
+		"test_cycle_macro_use.tpl":  "${ m() }",
+		"test_depth_1.tpl":          "1\n#include \"test_depth_2.tpl\"",
+		"test_depth_2.tpl":          "2\n#include \"test_depth_3.tpl\"",
+		"test_depth_3.tpl":          "3",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("创建测试文件失败: %v", err)
+		}
+		t.Cleanup(func() { os.Remove(name) })
+	}
+}
+
+// TestIncludeCycle 测试循环包含报告完整的包含链
+func TestIncludeCycle(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+	setupIncludeChainTestFiles(t)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		errMsg   string
+	}{
+		{
+			name:     "两个文件互相包含",
+			template: `#include "test_cycle_inc_a.tpl"`,
+			errMsg:   "#include cycle: test_cycle_inc_a.tpl -> test_cycle_inc_b.tpl -> test_cycle_inc_a.tpl",
+		},
+		{
+			name:     "包含自身",
+			template: `#include "test_cycle_inc_self.tpl"`,
+			context:  map[string]any{"depth": 1},
+			errMsg:   "#include cycle: test_cycle_inc_self.tpl -> test_cycle_inc_self.tpl",
+		},
+		{
+			name:     "only不会丢失包含链",
+			template: `#include "test_cycle_inc_a.tpl" with {} only`,
+			errMsg:   "#include cycle: test_cycle_inc_a.tpl -> test_cycle_inc_b.tpl -> test_cycle_inc_a.tpl",
+		},
+		{
+			name:     "经由call调用的宏循环包含",
+			template: `#include "test_cycle_macro_call.tpl"`,
+			errMsg:   "#include cycle: test_cycle_macro_call.tpl -> test_cycle_macro_call.tpl",
+		},
+		{
+			name:     "经由表达式调用的宏循环包含",
+			template: `#include "test_cycle_macro_expr.tpl"`,
+			errMsg:   "#include cycle: test_cycle_macro_expr.tpl -> test_cycle_macro_expr.tpl",
+		},
+		{
+			name:     "被包含模板调用继承的宏循环包含",
+			template: `#include "test_cycle_macro_with.tpl"`,
+			errMsg:   "#include cycle: test_cycle_macro_with.tpl -> test_cycle_macro_use.tpl -> test_cycle_macro_use.tpl",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			_, err = tpl.Render(tt.context)
+			if err == nil {
+				t.Fatalf("期望出现错误，但成功执行了")
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("期望错误包含 %q, 实际: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+// TestIncludeSameFileTwice 测试同一文件在不同分支中多次包含不是循环
+func TestIncludeSameFileTwice(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+	setupIncludeChainTestFiles(t)
+
+	tpl, err := eng.ParseString(`#include "test_depth_3.tpl"
+#include "test_depth_2.tpl"`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err := tpl.Render(map[string]any{})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "3\n2\n3"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+}
+
+// TestIncludeMaxDepth 测试包含层数限制
+func TestIncludeMaxDepth(t *testing.T) {
+	loader := os.DirFS(".")
+	setupIncludeChainTestFiles(t)
+
+	tests := []struct {
+		name     string
+		depth    int
+		expected string
+		errMsg   string
+	}{
+		{
+			name:     "未超过层数",
+			depth:    3,
+			expected: "1\n2\n3",
+		},
+		{
+			name:   "超过层数",
+			depth:  2,
+			errMsg: `#include "test_depth_3.tpl": maximum include depth 2 exceeded: test_depth_1.tpl -> test_depth_2.tpl -> test_depth_3.tpl`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := New(loader, WithMaxIncludeDepth(tt.depth))
+			tpl, err := eng.ParseString(`#include "test_depth_1.tpl"`)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			result, err := tpl.Render(map[string]any{})
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("期望错误包含 %q, 实际: %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+
+	t.Run("层数小于1时panic", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("期望 panic")
+			}
+		}()
+		New(loader, WithMaxIncludeDepth(0))
+	})
+}
+
+// TestIncludeCached 测试被包含的模板只读取和解析一次
+func TestIncludeCached(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	if err := os.WriteFile("test_cached_include.tpl", []byte("v1 ${name}"), 0644); err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	t.Cleanup(func() { os.Remove("test_cached_include.tpl") })
+
+	tpl, err := eng.ParseString(`#for name in names
+#include "test_cached_include.tpl"
+#end`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	ctx := map[string]any{"names": []string{"a", "b"}}
+	result, err := tpl.Render(ctx)
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "v1 a\nv1 b\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+
+	// 文件修改后同一引擎仍使用缓存的模板
+	if err := os.WriteFile("test_cached_include.tpl", []byte("v2 ${name}"), 0644); err != nil {
+		t.Fatalf("修改测试文件失败: %v", err)
+	}
+	result, err = tpl.Render(ctx)
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "v1 a\nv1 b\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+
+	// 新的引擎重新读取文件
+	tpl, err = New(loader).ParseString(`#include "test_cached_include.tpl"`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err = tpl.Render(map[string]any{"name": "c"})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "v2 c"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+}
+
+// setupRelativeIncludeTestFiles 创建相对路径包含测试用的目录和文件
+func setupRelativeIncludeTestFiles(t *testing.T) {
+	files := map[string]string{
+		"test_rel/components/web.yaml": `name: ${name}
+#include "probe.yaml"
+#include "/test_rel/common.yaml"
+#include "../common.yaml"
+#include "sidecars/log.yaml"`,
+		"test_rel/components/probe.yaml":          "probe: components",
+		"test_rel/components/sidecars/log.yaml":   "#include \"image.yaml\"",
+		"test_rel/components/sidecars/image.yaml": "image: sidecars",
+		"test_rel/common.yaml":                    "common: root",
+		"test_rel/probe.yaml":                     "probe: root",
+		"test_rel/pages/child.yaml": `#extends "../layouts/base.yaml"
+#block body
+#include "part.yaml"
+#end`,
+		"test_rel/pages/part.yaml": "part: pages",
+		"test_rel/layouts/base.yaml": `#include "header.yaml"
+#block body
+#end`,
+		"test_rel/layouts/header.yaml": "header: layouts",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatalf("创建测试目录失败: %v", err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("创建测试文件失败: %v", err)
+		}
+	}
+	t.Cleanup(func() { os.RemoveAll("test_rel") })
+}
+
+// TestIncludeRelativePath 测试相对于所在模板解析 #include 路径
+func TestIncludeRelativePath(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+	setupRelativeIncludeTestFiles(t)
+
+	tests := []struct {
+		name     string
+		file     string
+		template string
+		expected string
+	}{
+		{
+			name:     "相对于被包含文件所在目录",
+			file:     "test_rel/components/web.yaml",
+			expected: "name: web\nprobe: components\ncommon: root\ncommon: root\nimage: sidecars",
+		},
+		{
+			name:     "ParseString的模板相对于根目录",
+			template: "#include \"test_rel/probe.yaml\"\n#include \"/test_rel/components/probe.yaml\"",
+			expected: "probe: root\nprobe: components",
+		},
+		{
+			name:     "经过多层包含",
+			template: `#include "test_rel/components/web.yaml"`,
+			expected: "name: web\nprobe: components\ncommon: root\ncommon: root\nimage: sidecars",
+		},
+		{
+			name:     "extends和block中的include",
+			file:     "test_rel/pages/child.yaml",
+			expected: "header: layouts\npart: pages\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tpl *Template
+			var err error
+			if tt.file != "" {
+				tpl, err = eng.ParseFile(tt.file)
+			} else {
+				tpl, err = eng.ParseString(tt.template)
+			}
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			if tpl.Path() != tt.file {
+				t.Errorf("期望路径: %q, 实际: %q", tt.file, tpl.Path())
+			}
+
+			result, err := tpl.Render(map[string]any{"name": "web"})
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestResolvePath 测试 #include / #extends 路径的解析规则
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		from     string
+		name     string
+		expected string
+	}{
+		{"", "probe.yaml", "probe.yaml"},
+		{"", "components/probe.yaml", "components/probe.yaml"},
+		{"components/web.yaml", "probe.yaml", "components/probe.yaml"},
+		{"components/web.yaml", "./sub/../probe.yaml", "components/probe.yaml"},
+		{"components/web.yaml", "../base.yaml", "base.yaml"},
+		{"components/web.yaml", "/base.yaml", "base.yaml"},
+		{"web.yaml", "/components/probe.yaml", "components/probe.yaml"},
+	}
+
+	for _, tt := range tests {
+		if got := resolvePath(tt.from, tt.name); got != tt.expected {
+			t.Errorf("resolvePath(%q, %q) 期望: %q, 实际: %q", tt.from, tt.name, tt.expected, got)
+		}
+	}
+}
+
 // BenchmarkInclude 包含文件性能基准测试
 func BenchmarkInclude(b *testing.B) {
 	loader := os.DirFS(".")
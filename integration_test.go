@@ -127,8 +127,7 @@ spec:
   - host: demo.example.com
     http: { }
 # Snippet included
-app: demo-app
-`
+app: demo-app`
 
 	if result != expected {
 		t.Errorf("期望: %q, 实际: %q", expected, result)
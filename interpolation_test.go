@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -20,25 +21,25 @@ func TestVariableInterpolation(t *testing.T) {
 			name:     "基本字符串插值 - ${} 格式",
 			template: "Hello ${name}!",
 			context:  map[string]any{"name": "World"},
-			expected: "Hello World!\n",
+			expected: "Hello World!",
 		},
 		{
 			name:     "基本字符串插值 - #() 格式",
 			template: "Hello ${name}!",
 			context:  map[string]any{"name": "Go"},
-			expected: "Hello Go!\n",
+			expected: "Hello Go!",
 		},
 		{
 			name:     "数字插值",
 			template: "Count: ${count}",
 			context:  map[string]any{"count": 42},
-			expected: "Count: 42\n",
+			expected: "Count: 42",
 		},
 		{
 			name:     "布尔值插值",
 			template: "Enabled: ${enabled}",
 			context:  map[string]any{"enabled": true},
-			expected: "Enabled: true\n",
+			expected: "Enabled: true",
 		},
 		{
 			name:     "嵌套对象属性访问",
@@ -49,7 +50,7 @@ func TestVariableInterpolation(t *testing.T) {
 					"email": "zhangsan@example.com",
 				},
 			},
-			expected: "User: 张三, Email: zhangsan@example.com\n",
+			expected: "User: 张三, Email: zhangsan@example.com",
 		},
 		{
 			name:     "数组索引访问",
@@ -57,7 +58,7 @@ func TestVariableInterpolation(t *testing.T) {
 			context: map[string]any{
 				"items": []string{"apple", "banana", "cherry"},
 			},
-			expected: "First: apple, Second: banana\n",
+			expected: "First: apple, Second: banana",
 		},
 		{
 			name:     "混合格式插值",
@@ -66,7 +67,7 @@ func TestVariableInterpolation(t *testing.T) {
 				"name":  "Alice",
 				"count": 5,
 			},
-			expected: "Alice has 5 items\n",
+			expected: "Alice has 5 items",
 		},
 		{
 			name:     "表达式计算",
@@ -75,7 +76,7 @@ func TestVariableInterpolation(t *testing.T) {
 				"price":    10.5,
 				"quantity": 3,
 			},
-			expected: "Total: 31.5\n",
+			expected: "Total: 31.5",
 		},
 		{
 			name:     "字符串连接",
@@ -84,7 +85,7 @@ func TestVariableInterpolation(t *testing.T) {
 				"firstName": "John",
 				"lastName":  "Doe",
 			},
-			expected: "Full name: John Doe\n",
+			expected: "Full name: John Doe",
 		},
 		{
 			name:     "多行模板插值",
@@ -94,7 +95,7 @@ func TestVariableInterpolation(t *testing.T) {
 				"age":  25,
 				"city": "北京",
 			},
-			expected: "Name: 李四\nAge: 25\nCity: 北京\n",
+			expected: "Name: 李四\nAge: 25\nCity: 北京",
 		},
 	}
 
@@ -133,31 +134,31 @@ func TestInterpolationEdgeCases(t *testing.T) {
 			name:     "空值插值",
 			template: "Value: ${emptyValue}",
 			context:  map[string]any{"emptyValue": nil},
-			expected: "Value: \n",
+			expected: "Value: ",
 		},
 		{
 			name:     "零值插值",
 			template: "Count: ${zero}",
 			context:  map[string]any{"zero": 0},
-			expected: "Count: 0\n",
+			expected: "Count: 0",
 		},
 		{
 			name:     "空字符串插值",
 			template: "Text: '${empty}'",
 			context:  map[string]any{"empty": ""},
-			expected: "Text: ''\n",
+			expected: "Text: ''",
 		},
 		{
 			name:     "特殊字符插值",
 			template: "Special: ${special}",
 			context:  map[string]any{"special": "Hello\nWorld\t!"},
-			expected: "Special: Hello\nWorld\t!\n",
+			expected: "Special: Hello\nWorld\t!",
 		},
 		{
 			name:     "Unicode字符插值",
 			template: "Unicode: ${unicode}",
 			context:  map[string]any{"unicode": "你好世界 🌍"},
-			expected: "Unicode: 你好世界 🌍\n",
+			expected: "Unicode: 你好世界 🌍",
 		},
 		{
 			name:     "连续插值",
@@ -167,7 +168,7 @@ func TestInterpolationEdgeCases(t *testing.T) {
 				"b": " ",
 				"c": "World",
 			},
-			expected: "Hello World\n",
+			expected: "Hello World",
 		},
 	}
 
@@ -201,6 +202,122 @@ func TestInterpolationEdgeCases(t *testing.T) {
 	}
 }
 
+// TestNestedExpressionDelimiters 测试表达式中嵌套的括号和字符串字面量
+func TestNestedExpressionDelimiters(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "表达式中的map字面量",
+			template: `value: ${ {"a": 1, "b": 2}.b }`,
+			context:  map[string]any{},
+			expected: "value: 2",
+		},
+		{
+			name:     "带谓词的内置函数",
+			template: `big: ${ filter(xs, {# > 1}) }`,
+			context:  map[string]any{"xs": []int{1, 2, 3}},
+			expected: "big: [2 3]",
+		},
+		{
+			name:     "井号表达式中的嵌套函数调用",
+			template: `upper: #( strings.ToUpper(strings.TrimSpace(name)) )!`,
+			context:  map[string]any{"name": "  web  "},
+			expected: "upper: WEB!",
+		},
+		{
+			name:     "字符串字面量中的结束分隔符",
+			template: `${ "a}b" } #( "x)y" ) ${ 'q"}' }`,
+			context:  map[string]any{},
+			expected: "a}b x)y q\"}",
+		},
+		{
+			name:     "同一行多个嵌套表达式",
+			template: `${ len([1, [2, 3]]) }-#( (1 + 2) * (3 + 4) )-${ {"k": [1, 2]}.k[1] }`,
+			context:  map[string]any{},
+			expected: "2-21-2",
+		},
+		{
+			name:     "转义后的分隔符中包含表达式",
+			template: `export A=\${${name}}`,
+			context:  map[string]any{"name": "HOME"},
+			expected: "export A=${HOME}",
+		},
+		{
+			name:     "转义的未闭合分隔符按原样输出",
+			template: `broken: \${ {"a": 1 } and \#( f(x ) ok: ${ok}`,
+			context:  map[string]any{"ok": true},
+			expected: "broken: ${ {\"a\": 1 } and #( f(x ) ok: true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestUnbalancedExpressions 测试未闭合或括号不配对的表达式返回解析错误
+func TestUnbalancedExpressions(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "缺少右括号",
+			template: "a: 1\nx: ${ oops( }",
+			expected: `line 2: unclosed or unbalanced expression "${ oops( }"`,
+		},
+		{
+			name:     "多余的右括号",
+			template: "x: ${ a) } y",
+			expected: `line 1: unclosed or unbalanced expression "${ a) } y"`,
+		},
+		{
+			name:     "未闭合的字符串",
+			template: `x: #( "abc )`,
+			expected: `line 1: unclosed or unbalanced expression "#( \"abc )"`,
+		},
+		{
+			name:     "缺少结束分隔符",
+			template: "ok: ${ok}\nx: ${value",
+			expected: `line 2: unclosed or unbalanced expression "${value"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := eng.ParseString(tt.template)
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("期望: %q, 实际: %v", tt.expected, err)
+			}
+		})
+	}
+}
+
 // BenchmarkInterpolation 性能基准测试
 func BenchmarkInterpolation(b *testing.B) {
 	loader := os.DirFS(".")
@@ -224,4 +341,23 @@ func BenchmarkInterpolation(b *testing.B) {
 			b.Fatalf("渲染模板失败: %v", err)
 		}
 	}
-}
\ No newline at end of file
+}
+// BenchmarkParseString 模板解析性能基准测试
+func BenchmarkParseString(b *testing.B) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	var sb strings.Builder
+	for i := 0; i < 100; i++ {
+		sb.WriteString("  name: ${appName}-${env ?? \"dev\"}  # comment #(replicas * 2)\n")
+		sb.WriteString("  plain: line without any expressions\n")
+	}
+	template := sb.String()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := eng.ParseString(template); err != nil {
+			b.Fatalf("解析模板失败: %v", err)
+		}
+	}
+}
@@ -106,7 +106,7 @@ After loop`,
 			context: map[string]any{
 				"emptyArray": []string{},
 			},
-			expected: "After loop\n",
+			expected: "After loop",
 		},
 		{
 			name: "单元素数组循环",
@@ -298,7 +298,7 @@ Should not appear
 #end
 After loop`,
 			context:     map[string]any{"nullArray": nil},
-			expected:    "After loop\n",
+			expected:    "After loop",
 			shouldError: true, // nil值应该报错
 		},
 		{
@@ -308,7 +308,7 @@ Should not appear
 #end
 After loop`,
 			context:     map[string]any{},
-			expected:    "After loop\n",
+			expected:    "After loop",
 			shouldError: true, // 未定义变量应该报错
 		},
 		{
@@ -318,7 +318,7 @@ Should not appear
 #end
 After loop`,
 			context:  map[string]any{"emptyString": ""},
-			expected: "After loop\n",
+			expected: "After loop",
 		},
 		{
 			name: "空Map循环",
@@ -327,7 +327,7 @@ Should not appear
 #end
 After loop`,
 			context:  map[string]any{"emptyMap": map[string]any{}},
-			expected: "After loop\n",
+			expected: "After loop",
 		},
 		{
 			name: "包含nil元素的数组",
@@ -350,7 +350,7 @@ Outer item again: ${item}`,
 				"item":  "outer",
 				"items": []string{"inner1", "inner2"},
 			},
-			expected: "Outer item: outer\nInner item: inner1\nInner item: inner2\nOuter item again: outer\n",
+			expected: "Outer item: outer\nInner item: inner1\nInner item: inner2\nOuter item again: outer",
 		},
 	}
 
@@ -384,6 +384,508 @@ Outer item again: ${item}`,
 	}
 }
 
+// TestLoopElse 测试 #for 的 #else 分支
+func TestLoopElse(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	listTemplate := `ports:
+#for p in ports
+  - ${p}
+#else
+  []
+#end`
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "有元素时渲染循环体",
+			template: listTemplate,
+			context:  map[string]any{"ports": []int{80, 443}},
+			expected: "ports:\n  - 80\n  - 443\n",
+		},
+		{
+			name:     "空切片时渲染else",
+			template: listTemplate,
+			context:  map[string]any{"ports": []int{}},
+			expected: "ports:\n  []\n",
+		},
+		{
+			name:     "nil时渲染else",
+			template: listTemplate,
+			context:  map[string]any{"ports": nil},
+			expected: "ports:\n  []\n",
+		},
+		{
+			name:     "未定义变量时渲染else",
+			template: listTemplate,
+			context:  map[string]any{},
+			expected: "ports:\n  []\n",
+		},
+		{
+			name: "空map时渲染else",
+			template: `#for k, v in labels
+${k}: ${v}
+#else
+# no labels
+#end`,
+			context:  map[string]any{"labels": map[string]any{}},
+			expected: "# no labels\n",
+		},
+		{
+			name: "空字符串时渲染else",
+			template: `#for c in text
+${c}
+#else
+empty
+#end`,
+			context:  map[string]any{"text": ""},
+			expected: "empty\n",
+		},
+		{
+			name: "嵌套循环的else",
+			template: `#for c in containers
+${c.name}:
+#for p in c.ports
+  - ${p}
+#else
+  none
+#end
+#end`,
+			context: map[string]any{
+				"containers": []any{
+					map[string]any{"name": "web", "ports": []int{80}},
+					map[string]any{"name": "worker", "ports": []int{}},
+				},
+			},
+			expected: "web:\n  - 80\nworker:\n  none\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestLoopMetadata 测试循环体中的 loop 变量
+func TestLoopMetadata(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "从1开始的序号",
+			template: `#for item in items
+${loop.index}. ${item}
+#end`,
+			context:  map[string]any{"items": []string{"a", "b", "c"}},
+			expected: "1. a\n2. b\n3. c\n",
+		},
+		{
+			name: "index0和length",
+			template: `#for item in items
+${loop.index0}/${loop.length}
+#end`,
+			context:  map[string]any{"items": []string{"a", "b"}},
+			expected: "0/2\n1/2\n",
+		},
+		{
+			name: "使用last生成逗号分隔的JSON数组",
+			template: `[
+#for p in ports
+  ${p}${loop.last ? "" : ","}
+#end
+]`,
+			context:  map[string]any{"ports": []int{80, 443, 8080}},
+			expected: "[\n  80,\n  443,\n  8080\n]",
+		},
+		{
+			name: "first标记第一个元素",
+			template: `#for c in containers
+#if loop.first
+- ${c} (primary)
+#else
+- ${c}
+#end
+#end`,
+			context:  map[string]any{"containers": []string{"web", "sidecar"}},
+			expected: "- web (primary)\n- sidecar\n",
+		},
+		{
+			name: "even和odd",
+			template: `#for item in items
+${item}: ${loop.odd ? "odd" : "even"}
+#end`,
+			context:  map[string]any{"items": []string{"a", "b", "c"}},
+			expected: "a: odd\nb: even\nc: odd\n",
+		},
+		{
+			name: "嵌套循环通过parent访问外层循环",
+			template: `#for row in rows
+#for col in row
+${loop.parent.index}.${loop.index}=${col}
+#end
+#end`,
+			context: map[string]any{
+				"rows": [][]int{{1, 2}, {3}},
+			},
+			expected: "1.1=1\n1.2=2\n2.1=3\n",
+		},
+		{
+			name: "最外层循环的parent为nil",
+			template: `#for item in items
+${loop.parent ?? "none"}
+#end`,
+			context:  map[string]any{"items": []string{"a"}},
+			expected: "none\n",
+		},
+		{
+			name: "循环结束后恢复loop变量",
+			template: `#for item in items
+${item}
+#end
+${loop}`,
+			context:  map[string]any{"loop": "outer", "items": []string{"a"}},
+			expected: "a\nouter",
+		},
+		{
+			name: "map循环的loop变量",
+			template: `#for k, v in labels
+${loop.index}/${loop.length} ${k}=${v}
+#end`,
+			context:  map[string]any{"labels": map[string]any{"app": "web"}},
+			expected: "1/1 app=web\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestLoopBreakContinue 测试 #break 和 #continue
+func TestLoopBreakContinue(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name        string
+		template    string
+		context     map[string]any
+		expected    string
+		shouldError bool
+	}{
+		{
+			name: "带条件的continue",
+			template: `#for item in items
+#continue if item.disabled
+- ${item.name}
+#end`,
+			context: map[string]any{
+				"items": []any{
+					map[string]any{"name": "a"},
+					map[string]any{"name": "b", "disabled": true},
+					map[string]any{"name": "c"},
+				},
+			},
+			expected: "- a\n- c\n",
+		},
+		{
+			name: "带条件的break",
+			template: `#for n in numbers
+#break if n > 2
+${n}
+#end
+done`,
+			context:  map[string]any{"numbers": []int{1, 2, 3, 4}},
+			expected: "1\n2\ndone",
+		},
+		{
+			name: "嵌套在if中的break",
+			template: `#for n in numbers
+${n}
+#if n == 2
+stop
+#break
+#end
+#end`,
+			context:  map[string]any{"numbers": []int{1, 2, 3}},
+			expected: "1\n2\nstop\n",
+		},
+		{
+			name: "嵌套在if中的continue",
+			template: `#for n in numbers
+#if n % 2 == 0
+#continue
+#end
+${n}
+#end`,
+			context:  map[string]any{"numbers": []int{1, 2, 3, 4, 5}},
+			expected: "1\n3\n5\n",
+		},
+		{
+			name: "内层break不影响外层循环",
+			template: `#for row in rows
+#for col in row
+#break if col > 1
+${col}
+#end
+-
+#end`,
+			context:  map[string]any{"rows": [][]int{{1, 2, 3}, {1, 5}}},
+			expected: "1\n-\n1\n-\n",
+		},
+		{
+			name: "break后恢复循环变量",
+			template: `#for item in items
+#break
+#end
+${item}`,
+			context:  map[string]any{"item": "outer", "items": []string{"a"}},
+			expected: "outer",
+		},
+		{
+			name:        "循环外使用break",
+			template:    `#break`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+		{
+			name: "for的else分支中使用continue",
+			template: `#for item in items
+${item}
+#else
+#continue
+#end`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+		{
+			name: "宏体中使用break",
+			template: `#for item in items
+#define m()
+#break
+#end
+#end`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if tt.shouldError {
+				t.Errorf("期望出现错误，但成功执行了")
+				return
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestLoopClauses 测试 #for 的过滤、区间、排序和倒序子句
+func TestLoopClauses(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "if子句过滤元素",
+			template: `#for p in ports if p > 1024
+- ${p}
+#end`,
+			context:  map[string]any{"ports": []int{80, 8080, 443, 9090}},
+			expected: "- 8080\n- 9090\n",
+		},
+		{
+			name: "过滤后loop变量只统计保留的元素",
+			template: `#for c in containers if c.enabled
+${loop.index}/${loop.length} ${c.name}
+#end`,
+			context: map[string]any{
+				"containers": []any{
+					map[string]any{"name": "a", "enabled": true},
+					map[string]any{"name": "b", "enabled": false},
+					map[string]any{"name": "c", "enabled": true},
+				},
+			},
+			expected: "1/2 a\n2/2 c\n",
+		},
+		{
+			name: "全部被过滤时渲染else",
+			template: `#for p in ports if p > 10000
+${p}
+#else
+none
+#end`,
+			context:  map[string]any{"ports": []int{80}},
+			expected: "none\n",
+		},
+		{
+			name: "过滤条件中包含字符串里的if",
+			template: `#for s in items if s != " if "
+[${s}]
+#end`,
+			context:  map[string]any{"items": []string{"a", " if ", "b"}},
+			expected: "[a]\n[b]\n",
+		},
+		{
+			name: "数字区间",
+			template: `#for i in 1..replicas
+pod-${i}
+#end`,
+			context:  map[string]any{"replicas": 3},
+			expected: "pod-1\npod-2\npod-3\n",
+		},
+		{
+			name: "range函数",
+			template: `#for i in range(n)
+${i}
+#end`,
+			context:  map[string]any{"n": 3},
+			expected: "0\n1\n2\n",
+		},
+		{
+			name: "range指定起止和步长",
+			template: `#for i in range(10, 0, -4)
+${i}
+#end`,
+			context:  map[string]any{},
+			expected: "10\n6\n2\n",
+		},
+		{
+			name: "map按键排序",
+			template: `#for k, v in env sorted
+${k}=${v}
+#end`,
+			context: map[string]any{
+				"env": map[string]any{"ZONE": "a", "APP": "web", "LOG": "info"},
+			},
+			expected: "APP=web\nLOG=info\nZONE=a\n",
+		},
+		{
+			name: "数字切片排序",
+			template: `#for n in numbers sorted
+${n}
+#end`,
+			context:  map[string]any{"numbers": []int{10, 2, 33, 4}},
+			expected: "2\n4\n10\n33\n",
+		},
+		{
+			name: "倒序",
+			template: `#for x in xs reversed
+${x}
+#end`,
+			context:  map[string]any{"xs": []string{"a", "b", "c"}},
+			expected: "c\nb\na\n",
+		},
+		{
+			name: "过滤、排序与倒序组合",
+			template: `#for p in ports if p != 443 sorted reversed
+${p}
+#end`,
+			context:  map[string]any{"ports": []int{443, 80, 8080, 22}},
+			expected: "8080\n80\n22\n",
+		},
+		{
+			name: "名为sorted的变量不被当作修饰词",
+			template: `#for x in sorted
+${x}
+#end`,
+			context:  map[string]any{"sorted": []string{"b", "a"}},
+			expected: "b\na\n",
+		},
+		{
+			name: "过滤后恢复循环变量",
+			template: `#for x in xs if x > 5
+${x}
+#end
+${x}`,
+			context:  map[string]any{"x": "outer", "xs": []int{1, 2}},
+			expected: "outer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
 // BenchmarkLoop 循环性能基准测试
 func BenchmarkLoop(b *testing.B) {
 	loader := os.DirFS(".")
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMacros 测试 #define / #call 宏语法
+func TestMacros(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name        string
+		template    string
+		context     map[string]any
+		expected    string
+		shouldError bool
+	}{
+		{
+			name: "定义并通过#call调用宏",
+			template: `#define label(key, value)
+${key}: ${value}
+#end
+labels:
+  #call label("app", appName)
+  #call label("tier", "backend")`,
+			context:  map[string]any{"appName": "demo"},
+			expected: "labels:\napp: demo\ntier: backend\n",
+		},
+		{
+			name: "宏体保留自身缩进",
+			template: `#define probe(path, port)
+  httpGet:
+    path: ${path}
+    port: ${port}
+#end
+livenessProbe:
+#call probe("/healthz", 8080)
+readinessProbe:
+#call probe("/ready", 8080)`,
+			context:  map[string]any{},
+			expected: "livenessProbe:\n  httpGet:\n    path: /healthz\n    port: 8080\nreadinessProbe:\n  httpGet:\n    path: /ready\n    port: 8080\n",
+		},
+		{
+			name: "在表达式中内联调用宏",
+			template: `#define fullName(name, ns)
+${name}.${ns ?? "default"}
+#end
+host: ${fullName(appName, namespace)}.svc`,
+			context:  map[string]any{"appName": "web"},
+			expected: "host: web.default.svc",
+		},
+		{
+			name: "循环中调用宏",
+			template: `#define container(c)
+- name: ${c.name}
+  image: ${c.image}
+#end
+#for c in containers
+#call container(c)
+#end`,
+			context: map[string]any{
+				"containers": []any{
+					map[string]any{"name": "web", "image": "nginx"},
+					map[string]any{"name": "sidecar", "image": "busybox"},
+				},
+			},
+			expected: "- name: web\n  image: nginx\n- name: sidecar\n  image: busybox\n",
+		},
+		{
+			name: "宏使用独立的参数作用域",
+			template: `#define show(x)
+x=${x}, secret=${secret ?? "hidden"}
+#end
+#call show(secret)`,
+			context:  map[string]any{"secret": "s3cr3t"},
+			expected: "x=s3cr3t, secret=hidden\n",
+		},
+		{
+			name: "宏调用其他宏",
+			template: `#define quote(s)
+"${s}"
+#end
+#define pair(k, v)
+${k}: ${quote(v)}
+#end
+#call pair("image", "nginx:1.25")`,
+			context:  map[string]any{},
+			expected: "image: \"nginx:1.25\"\n",
+		},
+		{
+			name: "缺少的参数为nil",
+			template: `#define greet(name, title)
+Hello ${title ?? "Mr."} ${name}
+#end
+#call greet("Smith")`,
+			context:  map[string]any{},
+			expected: "Hello Mr. Smith\n",
+		},
+		{
+			name: "参数中包含逗号和函数调用",
+			template: `#define show(a, b)
+${a}|${b}
+#end
+#call show("x,y", strings.Repeat("ab", 2))`,
+			context:  map[string]any{},
+			expected: "x,y|abab\n",
+		},
+		{
+			name: "宏定义本身不产生输出",
+			template: `before
+#define unused()
+never rendered
+#end
+after`,
+			context:  map[string]any{},
+			expected: "before\nafter",
+		},
+		{
+			name:        "调用未定义的宏",
+			template:    `#call missing(1)`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+		{
+			name: "参数过多",
+			template: `#define one(a)
+${a}
+#end
+#call one(1, 2)`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+		{
+			name: "重复定义宏",
+			template: `#define dup()
+a
+#end
+#define dup()
+b
+#end`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+		{
+			name: "未闭合的宏定义",
+			template: `#define broken(a)
+${a}`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if tt.shouldError {
+				t.Errorf("期望出现错误，但成功执行了")
+				return
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestRenderDoesNotMutateContext 测试渲染不会修改调用方传入的上下文
+func TestRenderDoesNotMutateContext(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString(`#define m()
+x
+#end
+#for item in items
+${item}
+#end`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	ctx := map[string]any{"items": []string{"a", "b"}}
+	if _, err := tpl.Render(ctx); err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if len(ctx) != 1 {
+		t.Errorf("上下文被修改: %v", ctx)
+	}
+}
+
+// TestMacroRecursionDepth 测试宏递归调用的层数限制
+func TestMacroRecursionDepth(t *testing.T) {
+	loader := os.DirFS(".")
+	countdown := `#define count(n)
+#if n > 0
+${n}
+#call count(n - 1)
+#end
+#end
+#call count(3)`
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		template string
+		expected string
+		errMsg   string
+	}{
+		{
+			name:     "有限的递归",
+			template: countdown,
+			expected: "3\n2\n1\n",
+		},
+		{
+			name:     "超过层数",
+			opts:     []Option{WithMaxMacroDepth(3)},
+			template: countdown,
+			errMsg:   "macro count: maximum macro call depth 3 exceeded: count -> count -> count -> count",
+		},
+		{
+			name:     "经由call的无限递归",
+			template: "#define m()\n#call m()\n#end\n#call m()",
+			errMsg:   "maximum macro call depth 64 exceeded",
+		},
+		{
+			name:     "经由表达式的无限递归",
+			template: "#define m()\n${ m() }\n#end\n${ m() }",
+			errMsg:   "maximum macro call depth 64 exceeded",
+		},
+		{
+			name:     "互相调用的宏",
+			opts:     []Option{WithMaxMacroDepth(4)},
+			template: "#define a()\n#call b()\n#end\n#define b()\n#call a()\n#end\n#call a()",
+			errMsg:   "maximum macro call depth 4 exceeded: a -> b -> a -> b -> a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := New(loader, tt.opts...).ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			result, err := tpl.Render(map[string]any{})
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("期望错误包含 %q, 实际: %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+
+	t.Run("层数小于1时panic", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("期望 panic")
+			}
+		}()
+		New(loader, WithMaxMacroDepth(0))
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMultiLineExpressions 测试跨行表达式和指令续行
+func TestMultiLineExpressions(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "跨行的美元表达式",
+			template: `args: ${ strings.Join(
+    items,
+    ", ") }
+next: line`,
+			context:  map[string]any{"items": []string{"a", "b"}},
+			expected: "args: a, b\nnext: line",
+		},
+		{
+			name: "跨行的井号表达式",
+			template: `sum: #( 1 +
+  2 ) units`,
+			context:  map[string]any{},
+			expected: "sum: 3 units",
+		},
+		{
+			name: "指令续行",
+			template: `#if env == "prod" && \
+    replicas > 1
+ha: true
+#end`,
+			context:  map[string]any{"env": "prod", "replicas": 3},
+			expected: "ha: true\n",
+		},
+		{
+			name: "多次续行的for指令",
+			template: `#for p in ports \
+    if p > 1024 \
+    sorted
+- ${p}
+#end`,
+			context:  map[string]any{"ports": []int{9090, 80, 8080}},
+			expected: "- 8080\n- 9090\n",
+		},
+		{
+			name: "普通文本行末尾的反斜杠保持原样",
+			template: `command: |
+  docker run \
+    --name ${name} \
+    nginx`,
+			context:  map[string]any{"name": "web"},
+			expected: "command: |\n  docker run \\\n    --name web \\\n    nginx",
+		},
+		{
+			name: "非指令的注释行末尾的反斜杠保持原样",
+			template: `#run the build with \
+docker build .
+#region setup \
+x: ${x}`,
+			context:  map[string]any{"x": 1},
+			expected: "#run the build with \\\ndocker build .\n#region setup \\\nx: 1",
+		},
+		{
+			name: "注释块之后的跨行表达式",
+			template: `#* 说明 *# a: ${ 1 +
+  2 }`,
+			context:  map[string]any{},
+			expected: " a: 3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestMultiLineUnclosedLongTemplate 测试未闭合的表达式后面有大量行时解析仍然是线性的
+func TestMultiLineUnclosedLongTemplate(t *testing.T) {
+	eng := New(os.DirFS("."))
+	var sb strings.Builder
+	sb.WriteString("a: ${unclosed\n")
+	for i := 0; i < 20000; i++ {
+		sb.WriteString("key: (value\n")
+	}
+	_, err := eng.ParseString(sb.String())
+	if expected := `line 1: unclosed or unbalanced expression "${unclosed"`; err == nil || err.Error() != expected {
+		t.Errorf("期望: %q, 实际: %v", expected, err)
+	}
+}
+
+// TestErrorLineNumbers 测试错误信息中的行号
+func TestErrorLineNumbers(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name       string
+		template   string
+		context    map[string]any
+		parseError bool
+		errorMsg   string
+	}{
+		{
+			name: "未闭合的if",
+			template: `line1
+line2
+#if cond
+body`,
+			parseError: true,
+			errorMsg:   "line 3: unterminated #if",
+		},
+		{
+			name: "跨行表达式之后的未闭合for",
+			template: `value: ${ strings.Join(
+  items, ",") }
+#for x in xs
+body`,
+			parseError: true,
+			errorMsg:   "line 3: unterminated #for",
+		},
+		{
+			name: "到文件末尾仍未闭合的表达式",
+			template: `ok: ${value}
+a: ${unclosed
+b: ${value}`,
+			parseError: true,
+			errorMsg:   `line 2: unclosed or unbalanced expression "${unclosed"`,
+		},
+		{
+			name: "未闭合的表达式不会跨过指令行",
+			template: `a: ${unclosed
+#if true
+b: }
+#end`,
+			parseError: true,
+			errorMsg:   `line 1: unclosed or unbalanced expression "${unclosed"`,
+		},
+		{
+			name: "跨行表达式之后的括号不配对",
+			template: `a: ${ strings.Join(
+  items, ",") } b: #( f(x )`,
+			parseError: true,
+			errorMsg:   `line 2: unclosed or unbalanced expression "#( f(x )"`,
+		},
+		{
+			name: "续行指令之后的表达式错误",
+			template: `#if a && \
+   b
+ok
+#end
+result: ${10 / 0}`,
+			context:  map[string]any{"a": true, "b": true},
+			errorMsg: "line 5:",
+		},
+		{
+			name: "同一逻辑行中跨行表达式之后的表达式错误",
+			template: `x: ${ strings.Join(
+  items, ",") } ${10 / 0}`,
+			context:  map[string]any{"items": []string{"a"}},
+			errorMsg: "line 2:",
+		},
+		{
+			name: "循环体中的错误",
+			template: `#for x in xs
+ok
+#set y = x / 0
+#end`,
+			context:  map[string]any{"xs": []int{1}},
+			errorMsg: "line 3: #set y",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if tt.parseError {
+				if err == nil {
+					t.Fatalf("期望解析失败，但解析成功了")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("解析模板失败: %v", err)
+				}
+				_, err = tpl.Render(tt.context)
+				if err == nil {
+					t.Fatalf("期望渲染失败，但渲染成功了")
+				}
+			}
+
+			if !strings.Contains(err.Error(), tt.errorMsg) {
+				t.Errorf("期望错误消息包含 %q, 实际: %v", tt.errorMsg, err)
+			}
+		})
+	}
+}
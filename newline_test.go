@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestLineEndings 测试输出保留模板源码的换行符和末尾换行
+func TestLineEndings(t *testing.T) {
+	err := os.WriteFile("test_newline_partial.tpl", []byte("partial: ${x}"), 0644)
+	if err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	defer os.Remove("test_newline_partial.tpl")
+	err = os.WriteFile("test_newline_partial_lf.tpl", []byte("partial: ${x}\n"), 0644)
+	if err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	defer os.Remove("test_newline_partial_lf.tpl")
+
+	tests := []struct {
+		name      string
+		template  string
+		normalize bool
+		expected  string
+	}{
+		{
+			name:     "末尾没有换行",
+			template: "a: ${x}\nb: 2",
+			expected: "a: 1\nb: 2",
+		},
+		{
+			name:     "末尾有换行",
+			template: "a: ${x}\nb: 2\n",
+			expected: "a: 1\nb: 2\n",
+		},
+		{
+			name:     "保留CRLF",
+			template: "a: ${x}\r\nb: 2\r\n",
+			expected: "a: 1\r\nb: 2\r\n",
+		},
+		{
+			name:     "混合换行符",
+			template: "a\r\nb\nc\r\n",
+			expected: "a\r\nb\nc\r\n",
+		},
+		{
+			name:     "指令行连同换行符一起删除",
+			template: "#if true\r\n  x: ${x}\r\n#end\r\ny\r\n",
+			expected: "  x: 1\r\ny\r\n",
+		},
+		{
+			name:     "循环体保留CRLF",
+			template: "#for i in range(2)\r\n- ${i}\r\n#end",
+			expected: "- 0\r\n- 1\r\n",
+		},
+		{
+			name:     "跨行表达式",
+			template: "v: ${ x +\r\n  1 }\r\nend",
+			expected: "v: 2\r\nend",
+		},
+		{
+			name:     "raw块保留CRLF",
+			template: "#raw\r\n${x}\r\n#end\r\n",
+			expected: "${x}\r\n",
+		},
+		{
+			name:     "空模板",
+			template: "",
+			expected: "",
+		},
+		{
+			name:     "只有换行",
+			template: "\r\n",
+			expected: "\r\n",
+		},
+		{
+			name:     "被包含的文件末尾没有换行时补上指令行的换行符",
+			template: "a\r\n#include \"test_newline_partial.tpl\"\r\nb",
+			expected: "a\r\npartial: 1\r\nb",
+		},
+		{
+			name:     "被包含的文件末尾有换行时不重复添加",
+			template: "a\n#include \"test_newline_partial_lf.tpl\"\nb\n",
+			expected: "a\npartial: 1\nb\n",
+		},
+		{
+			name:     "最后一行的include不添加换行",
+			template: "a\n#include \"test_newline_partial.tpl\"",
+			expected: "a\npartial: 1",
+		},
+		{
+			name:     "表达式中调用宏时去掉CRLF",
+			template: "#define greet(n)\r\nhi ${n}\r\n#end\r\n[${ greet(\"x\") }]\r\n",
+			expected: "[hi x]\r\n",
+		},
+		{
+			name:      "统一换行符并补上末尾换行",
+			template:  "a: ${x}\r\nb: 2",
+			normalize: true,
+			expected:  "a: 1\nb: 2\n",
+		},
+		{
+			name:      "统一换行符时末尾换行不重复",
+			template:  "a\r\nb\r\n",
+			normalize: true,
+			expected:  "a\nb\n",
+		},
+		{
+			name:      "统一换行符时被包含的文件也补上末尾换行",
+			template:  "#include \"test_newline_partial.tpl\"\r\nb",
+			normalize: true,
+			expected:  "partial: 1\nb\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.normalize {
+				opts = append(opts, WithNormalizedNewlines())
+			}
+			eng := New(os.DirFS("."), opts...)
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(map[string]any{"x": 1})
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/fs"
-	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -13,7 +14,10 @@ type node interface {
 }
 
 // textNode 文本节点，直接输出文本内容
-type textNode struct{ text string }
+type textNode struct {
+	text string
+	line int // 文本在模板中的起始行号
+}
 
 // render 渲染文本节点
 func (n *textNode) render(sb *strings.Builder, _ *Engine, _ map[string]any) error {
@@ -22,19 +26,20 @@ func (n *textNode) render(sb *strings.Builder, _ *Engine, _ map[string]any) erro
 }
 
 // exprNode 表达式节点，计算表达式并输出结果
-type exprNode struct{ code string }
+type exprNode struct {
+	code      string
+	prog      *program // 解析时编译的表达式
+	trimLeft  bool     // ${- ...}：裁剪表达式之前的空白，仅在解析时使用
+	trimRight bool     // ${... -}：裁剪表达式之后的空白，仅在解析时使用
+	line      int      // 表达式在模板中的行号
+}
 
 // render 渲染表达式节点
 func (n *exprNode) render(sb *strings.Builder, _ *Engine, ctx map[string]any) error {
-	// 检查是否在循环上下文中，如果是，则对嵌套属性访问进行安全包装
-	code := n.code
-	if isInLoopContext(ctx) {
-		code = preprocessNestedAccess(code)
-	}
-	
-	val, err := evalExpr(code, ctx)
+	// 在循环上下文中对嵌套属性访问进行安全包装
+	val, err := n.prog.inContext(ctx).eval(ctx)
 	if err != nil {
-		return err
+		return lineError(n.line, err)
 	}
 	if val != nil {
 		sb.WriteString(fmt.Sprintf("%v", val))
@@ -42,71 +47,228 @@ func (n *exprNode) render(sb *strings.Builder, _ *Engine, ctx map[string]any) er
 	return nil
 }
 
+// setNode 变量定义节点，由 #set name = expr 或 #let name = expr 生成
+type setNode struct {
+	name  string
+	value *program
+	line  int
+}
+
+// render 计算表达式并将结果绑定到当前作用域
+func (n *setNode) render(_ *strings.Builder, _ *Engine, ctx map[string]any) error {
+	val, err := n.value.inContext(ctx).eval(ctx)
+	if err != nil {
+		return fmt.Errorf("line %d: #set %s: %w", n.line, n.name, err)
+	}
+	ctx[n.name] = val
+	return nil
+}
+
+// trimEOL 去掉末尾的一个换行符（\n 或 \r\n），用于在表达式中内联渲染结果
+func trimEOL(s string) string {
+	if strings.HasSuffix(s, "\n") {
+		return strings.TrimSuffix(s[:len(s)-1], "\r")
+	}
+	return s
+}
+
+// lineError 为错误添加模板行号
+func lineError(line int, err error) error {
+	return fmt.Errorf("line %d: %w", line, err)
+}
+
+// renderBlock 渲染 #if / #for 等块中的节点
+// 块中 #set 定义的变量只在块内有效，渲染结束后恢复为块外的值
+func renderBlock(sb *strings.Builder, eng *Engine, ctx map[string]any, nodes []node) error {
+	type savedVar struct {
+		value  any
+		exists bool
+	}
+	var saved map[string]savedVar
+	for _, c := range nodes {
+		if s, ok := c.(*setNode); ok {
+			if saved == nil {
+				saved = map[string]savedVar{}
+			}
+			if _, done := saved[s.name]; !done {
+				v, exists := ctx[s.name]
+				saved[s.name] = savedVar{value: v, exists: exists}
+			}
+		}
+	}
+	defer func() {
+		for name, v := range saved {
+			if v.exists {
+				ctx[name] = v.value
+			} else {
+				delete(ctx, name)
+			}
+		}
+	}()
+
+	for _, c := range nodes {
+		if err := c.render(sb, eng, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ifNode 条件节点，根据条件执行不同的分支
 type ifNode struct {
-	cond  string
-	thenN []node
-	elseN []node
+	cond     *program
+	thenN    []node
+	elifs    []elifBranch // #elif / #else if 分支，按顺序求值
+	elseN    []node
+	elseLine int // #else 所在行号，为 0 表示没有 #else 分支
+	line     int
+}
+
+// elifBranch 条件节点中的一个 #elif 分支
+type elifBranch struct {
+	cond *program
+	body []node
+	line int
 }
 
 // render 渲染条件节点
 func (n *ifNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) error {
-	condResult, err := evalBool(n.cond, ctx)
+	nodes, err := n.selectBranch(ctx)
 	if err != nil {
 		return err
 	}
 
-	var nodes []node
+	return renderBlock(sb, eng, ctx, nodes)
+}
+
+// selectBranch 依次计算 #if 和各 #elif 条件，返回第一个成立的分支，都不成立时返回 #else 分支
+func (n *ifNode) selectBranch(ctx map[string]any) ([]node, error) {
+	condResult, err := n.cond.evalBool(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: #if: %w", n.line, err)
+	}
 	if condResult {
-		nodes = n.thenN
-	} else {
-		nodes = n.elseN
+		return n.thenN, nil
+	}
+	for _, b := range n.elifs {
+		condResult, err := b.cond.evalBool(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: #elif: %w", b.line, err)
+		}
+		if condResult {
+			return b.body, nil
+		}
 	}
+	return n.elseN, nil
+}
 
-	for _, child := range nodes {
-		if err := child.render(sb, eng, ctx); err != nil {
-			return err
+// switchNode 多路选择节点，由 #switch expr ... #case v1, v2 ... #default ... #end 生成
+type switchNode struct {
+	subject     *program
+	cases       []switchCase
+	defaultN    []node
+	defaultLine int // #default 所在行号，为 0 表示没有 #default 分支
+	line        int
+}
+
+// switchCase 多路选择节点中的一个 #case 分支
+type switchCase struct {
+	values []*program // 候选值表达式，任意一个与 subject 相等即命中
+	body   []node
+	line   int
+}
+
+// render 计算一次 subject，渲染第一个值相等的 #case 分支，都不相等时渲染 #default 分支
+func (n *switchNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) error {
+	subject, err := n.subject.eval(ctx)
+	if err != nil {
+		return fmt.Errorf("line %d: #switch: %w", n.line, err)
+	}
+	for _, c := range n.cases {
+		for _, v := range c.values {
+			val, err := v.eval(ctx)
+			if err != nil {
+				return fmt.Errorf("line %d: #case: %w", c.line, err)
+			}
+			if equalValues(subject, val) {
+				return renderBlock(sb, eng, ctx, c.body)
+			}
 		}
 	}
-	return nil
+	return renderBlock(sb, eng, ctx, n.defaultN)
+}
+
+// equalValues 比较两个值是否相等，不同类型的数字按数值比较
+func equalValues(a, b any) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
 }
 
 // forNode 循环节点，支持迭代多种数据类型
 type forNode struct {
-	varName  string // 第一个变量名（或唯一变量名）
-	varName2 string // 第二个变量名（用于 key, value 语法）
-	iter     string // expression that should evaluate to slice/array/map/string
+	varName  string   // 第一个变量名（或唯一变量名）
+	varName2 string   // 第二个变量名（用于 key, value 语法）
+	iter     *program // expression that should evaluate to slice/array/map/string
 	body     []node
+	filter   *program // 可选的 if 子句，只保留条件成立的元素
+	sorted   bool     // 按值（映射按键）排序
+	reversed bool     // 倒序迭代
+	elseN    []node   // 可迭代对象为 nil 或没有元素时渲染的 #else 分支
+	elseLine int      // #else 所在行号，为 0 表示没有 #else 分支
+	line     int
+}
+
+// loopItem 循环中的一个元素
+type loopItem struct {
+	key   any // 切片/字符串的索引或映射的键
+	value any // 元素值
+	elem  any // 单变量语法绑定的值：切片/字符串为元素值，映射为键
 }
 
 // render 渲染for循环节点
 func (n *forNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) error {
-	val, err := evalExpr(n.iter, ctx)
+	val, err := n.iter.eval(ctx)
 	if err != nil {
-		return fmt.Errorf("#for eval failed: %w", err)
+		return fmt.Errorf("line %d: #for eval failed: %w", n.line, err)
+	}
+
+	// 存在 #else 分支时，nil 视为空集合
+	if val == nil && n.elseLine > 0 {
+		return renderBlock(sb, eng, ctx, n.elseN)
+	}
+	items, err := loopItems(val)
+	if err != nil {
+		return lineError(n.line, err)
+	}
+	if n.sorted {
+		sortLoopItems(items)
+	}
+	if n.reversed {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
 	}
 
 	// 保存原始变量值以恢复作用域
 	var originalVar1, originalVar2, originalLoopMarker any
 	var hasVar1, hasVar2, hasLoopMarker bool
-	if originalVar1, hasVar1 = ctx[n.varName]; hasVar1 {
-		// 保存原始值
-	}
+	originalVar1, hasVar1 = ctx[n.varName]
 	if n.varName2 != "" {
-		if originalVar2, hasVar2 = ctx[n.varName2]; hasVar2 {
-			// 保存原始值
-		}
+		originalVar2, hasVar2 = ctx[n.varName2]
 	}
-	// 保存循环标记
-	if originalLoopMarker, hasLoopMarker = ctx["__in_loop__"]; hasLoopMarker {
-		// 保存原始值
+	// 保存循环标记和外层循环的 loop 变量
+	originalLoopMarker, hasLoopMarker = ctx["__in_loop__"]
+	originalLoop, hasLoop := ctx["loop"]
+	var parentLoop any
+	if hasLoopMarker {
+		parentLoop = originalLoop
 	}
 
-	// 设置循环上下文标记
-	ctx["__in_loop__"] = true
-
-	// 确保在函数结束时恢复原始变量值
-	defer func() {
+	// 恢复原始变量值，可重复调用
+	restore := func() {
 		if hasVar1 {
 			ctx[n.varName] = originalVar1
 		} else {
@@ -125,162 +287,498 @@ func (n *forNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) e
 		} else {
 			delete(ctx, "__in_loop__")
 		}
-	}()
+		if hasLoop {
+			ctx["loop"] = originalLoop
+		} else {
+			delete(ctx, "loop")
+		}
+	}
+	// 确保在函数结束时恢复原始变量值
+	defer restore()
+
+	// 设置循环上下文标记
+	ctx["__in_loop__"] = true
+
+	// 按 if 子句过滤元素，过滤发生在生成 loop 变量之前，loop.length 等只统计保留的元素
+	if n.filter != nil {
+		kept := items[:0]
+		for _, item := range items {
+			n.bindItem(ctx, item)
+			ok, err := n.filter.evalBool(ctx)
+			if err != nil {
+				return fmt.Errorf("line %d: #for filter failed: %w", n.line, err)
+			}
+			if ok {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+
+	if len(items) == 0 {
+		restore()
+		return renderBlock(sb, eng, ctx, n.elseN)
+	}
+
+	for i, item := range items {
+		ctx["loop"] = loopMeta(i, len(items), parentLoop)
+		n.bindItem(ctx, item)
+		if err := renderBlock(sb, eng, ctx, n.body); err != nil {
+			if errors.Is(err, errContinue) {
+				continue
+			}
+			if errors.Is(err, errBreak) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// bindItem 将元素绑定到循环变量
+func (n *forNode) bindItem(ctx map[string]any, item loopItem) {
+	if n.varName2 != "" {
+		// key, value 语法
+		ctx[n.varName] = item.key
+		ctx[n.varName2] = item.value
+	} else {
+		// 单变量语法
+		ctx[n.varName] = item.elem
+	}
+}
+
+// sortLoopItems 按单变量语法绑定的值排序：切片按元素值，映射按键
+func sortLoopItems(items []loopItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return lessValue(items[i].elem, items[j].elem)
+	})
+}
+
+// lessValue 比较两个值的大小，数字按数值比较，其他类型按字符串形式比较
+func lessValue(a, b any) bool {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		return fa < fb
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// toFloat 将数字类型转换为 float64
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// errBreak 和 errContinue 由 #break / #continue 返回，沿渲染调用链传递到最近的 forNode
+var (
+	errBreak    = errors.New("#break outside of #for")
+	errContinue = errors.New("#continue outside of #for")
+)
+
+// loopCtlNode 循环控制节点，由 #break / #continue 生成，可带 if 条件
+type loopCtlNode struct {
+	brk  bool     // true 为 #break，false 为 #continue
+	cond *program // 可选条件，为 nil 时无条件执行
+	line int
+}
+
+// render 条件成立时返回对应的循环控制错误
+func (n *loopCtlNode) render(_ *strings.Builder, _ *Engine, ctx map[string]any) error {
+	if n.cond != nil {
+		ok, err := n.cond.evalBool(ctx)
+		if err != nil {
+			return lineError(n.line, err)
+		}
+		if !ok {
+			return nil
+		}
+	}
+	if n.brk {
+		return errBreak
+	}
+	return errContinue
+}
+
+// loopMeta 创建循环体中可用的 loop 变量
+// index 从 1 开始，index0 从 0 开始，even/odd 按 index 计算，parent 为外层循环的 loop 变量
+func loopMeta(i, length int, parent any) map[string]any {
+	return map[string]any{
+		"index":  i + 1,
+		"index0": i,
+		"first":  i == 0,
+		"last":   i == length-1,
+		"length": length,
+		"even":   (i+1)%2 == 0,
+		"odd":    (i+1)%2 == 1,
+		"parent": parent,
+	}
+}
 
+// loopItems 将可迭代的值展开为循环元素列表
+func loopItems(val any) ([]loopItem, error) {
+	var items []loopItem
 	switch v := val.(type) {
 	case []any:
 		for i, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = i
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法
-				ctx[n.varName] = item
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			items = append(items, loopItem{key: i, value: item, elem: item})
 		}
 	case []string:
 		for i, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = i
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法
-				ctx[n.varName] = item
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			items = append(items, loopItem{key: i, value: item, elem: item})
 		}
 	case []int:
 		for i, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = i
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法
-				ctx[n.varName] = item
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			items = append(items, loopItem{key: i, value: item, elem: item})
 		}
 	case []map[string]any:
 		for i, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = i
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法
-				ctx[n.varName] = item
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			items = append(items, loopItem{key: i, value: item, elem: item})
 		}
 	case [][]int:
 		for i, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = i
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法
-				ctx[n.varName] = item
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			items = append(items, loopItem{key: i, value: item, elem: item})
 		}
 	case map[string]interface{}:
 		for k, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = k
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法，只设置 key
-				ctx[n.varName] = k
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			// 单变量语法只绑定 key
+			items = append(items, loopItem{key: k, value: item, elem: k})
 		}
 	case map[string]string:
 		for k, item := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = k
-				ctx[n.varName2] = item
-			} else {
-				// 单变量语法，只设置 key
-				ctx[n.varName] = k
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			// 单变量语法只绑定 key
+			items = append(items, loopItem{key: k, value: item, elem: k})
 		}
 	case string:
 		for i, r := range v {
-			if n.varName2 != "" {
-				// key, value 语法
-				ctx[n.varName] = i
-				ctx[n.varName2] = string(r)
-			} else {
-				// 单变量语法
-				ctx[n.varName] = string(r)
-			}
-			for _, c := range n.body {
-				if err := c.render(sb, eng, ctx); err != nil {
-					return err
-				}
-			}
+			items = append(items, loopItem{key: i, value: string(r), elem: string(r)})
 		}
 	default:
-		return fmt.Errorf("#for does not support iterating %T", val)
+		return nil, fmt.Errorf("#for does not support iterating %T", val)
 	}
+	return items, nil
+}
+
+// 作用域中保存宏状态的内部键
+const (
+	macrosKey     = "__macros__"      // 当前可用的宏
+	macroCallsKey = "__macro_calls__" // 正在执行的宏调用链，用于限制递归调用的层数
+)
+
+// macroNode 宏定义节点，由 #define name(a, b) ... #end 生成，自身不产生输出
+type macroNode struct {
+	name   string
+	params []string
+	body   []node
+	line   int
+}
+
+// render 宏定义在原位置不输出任何内容
+func (n *macroNode) render(_ *strings.Builder, _ *Engine, _ map[string]any) error {
 	return nil
 }
 
+// call 使用给定参数渲染宏体，宏体只能看到自己的参数和其他宏
+// caller 为调用处的作用域，其中的 #include 链和宏调用链带入宏体，
+// 以便检测经由宏的循环包含，并限制包含和递归调用的嵌套层数
+func (n *macroNode) call(eng *Engine, macros map[string]*macroNode, args []any, caller map[string]any) (string, error) {
+	if len(args) > len(n.params) {
+		return "", fmt.Errorf("macro %s expects at most %d arguments, got %d", n.name, len(n.params), len(args))
+	}
+	calls, _ := caller[macroCallsKey].([]string)
+	if depth := eng.macroDepth(); len(calls) >= depth {
+		return "", &macroDepthError{fmt.Sprintf("macro %s: maximum macro call depth %d exceeded: %s -> %s", n.name, depth, strings.Join(calls, " -> "), n.name)}
+	}
+
+	scope := make(map[string]any, len(builtins)+len(macros)+len(n.params)+3)
+	withBuiltins(scope)
+	if includes, ok := caller[includesKey]; ok {
+		scope[includesKey] = includes
+	}
+	scope[macroCallsKey] = append(calls[:len(calls):len(calls)], n.name)
+	bindMacros(scope, eng, macros)
+	for i, param := range n.params {
+		if i < len(args) {
+			scope[param] = args[i]
+		} else {
+			scope[param] = nil
+		}
+	}
+
+	var sb strings.Builder
+	for _, c := range n.body {
+		if err := c.render(&sb, eng, scope); err != nil {
+			// 超过层数的错误已经包含完整的调用链，不再逐层添加外层宏的信息
+			var depthErr *macroDepthError
+			if errors.As(err, &depthErr) {
+				return "", depthErr
+			}
+			return "", fmt.Errorf("macro %s: %w", n.name, err)
+		}
+	}
+	return sb.String(), nil
+}
+
+// macroDepthError 宏调用超过最大嵌套层数的错误
+type macroDepthError struct {
+	msg string
+}
+
+// Error 实现 error 接口
+func (e *macroDepthError) Error() string {
+	return e.msg
+}
+
+// bindMacros 将宏注册到作用域中，使其既能通过 #call 调用，也能在表达式中作为函数调用
+// 在表达式中调用时去掉宏体末尾的换行，便于内联使用
+func bindMacros(scope map[string]any, eng *Engine, macros map[string]*macroNode) {
+	scope[macrosKey] = macros
+	for name, m := range macros {
+		scope[name] = m.bind(eng, macros, scope)
+	}
+}
+
+// bind 生成与宏参数个数一致的函数值，供表达式调用
+// 不使用可变参数函数，因为 expr 在可变参数中传入 nil 时会出错；
+// 调用时从 scope 中读取当前的 #include 链和宏调用链
+func (n *macroNode) bind(eng *Engine, macros map[string]*macroNode, scope map[string]any) any {
+	in := make([]reflect.Type, len(n.params))
+	for i := range in {
+		in[i] = anyType
+	}
+	fnType := reflect.FuncOf(in, []reflect.Type{stringType, errorType}, false)
+	fn := reflect.MakeFunc(fnType, func(values []reflect.Value) []reflect.Value {
+		args := make([]any, len(values))
+		for i, v := range values {
+			args[i] = v.Interface()
+		}
+		out, err := n.call(eng, macros, args, scope)
+		errValue := reflect.Zero(errorType)
+		if err != nil {
+			errValue = reflect.ValueOf(err)
+		}
+		return []reflect.Value{reflect.ValueOf(trimEOL(out)), errValue}
+	})
+	return fn.Interface()
+}
+
+var (
+	anyType    = reflect.TypeOf((*any)(nil)).Elem()
+	stringType = reflect.TypeOf("")
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// callNode 宏调用节点，由 #call name(expr, expr) 生成
+type callNode struct {
+	name string
+	args []*program // 参数表达式
+	line int
+}
+
+// render 计算参数并渲染宏
+func (n *callNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) error {
+	macros, _ := ctx[macrosKey].(map[string]*macroNode)
+	m, ok := macros[n.name]
+	if !ok {
+		return fmt.Errorf("line %d: #call: undefined macro %q", n.line, n.name)
+	}
+
+	args := make([]any, 0, len(n.args))
+	for _, arg := range n.args {
+		val, err := arg.eval(ctx)
+		if err != nil {
+			return fmt.Errorf("line %d: #call %s: %w", n.line, n.name, err)
+		}
+		args = append(args, val)
+	}
+
+	out, err := m.call(eng, macros, args, ctx)
+	if err != nil {
+		return lineError(n.line, err)
+	}
+	sb.WriteString(out)
+	return nil
+}
+
+// 作用域中保存模板继承状态的内部键
+const (
+	blocksKey  = "__blocks__"  // 子模板对 #block 的覆盖，按名称索引，越靠近子模板越靠前
+	extendsKey = "__extends__" // 已经经过的父模板路径，用于检测循环继承
+)
+
+// blockNode 可覆盖区域节点，由 #block name ... #end 生成
+type blockNode struct {
+	name string
+	body []node
+	line int
+}
+
+// render 渲染区域内容，如果子模板覆盖了该区域则渲染覆盖后的内容
+func (n *blockNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) error {
+	chain := []*blockNode{n}
+	if overrides, ok := ctx[blocksKey].(map[string][]*blockNode); ok && len(overrides[n.name]) > 0 {
+		chain = append(append([]*blockNode(nil), overrides[n.name]...), n)
+	}
+	return renderBlockChain(sb, eng, ctx, chain)
+}
+
+// renderBlockChain 渲染覆盖链中的第一个区域，其中可以通过 super() 获取下一层（父模板）的内容
+func renderBlockChain(sb *strings.Builder, eng *Engine, ctx map[string]any, chain []*blockNode) error {
+	prev, hadPrev := ctx["super"]
+	ctx["super"] = func() (string, error) {
+		if len(chain) == 1 {
+			return "", nil
+		}
+		var inner strings.Builder
+		if err := renderBlockChain(&inner, eng, ctx, chain[1:]); err != nil {
+			return "", err
+		}
+		return trimEOL(inner.String()), nil
+	}
+	defer func() {
+		if hadPrev {
+			ctx["super"] = prev
+		} else {
+			delete(ctx, "super")
+		}
+	}()
+
+	b := chain[0]
+	if err := renderBlock(sb, eng, ctx, b.body); err != nil {
+		return fmt.Errorf("line %d: #block %s: %w", b.line, b.name, err)
+	}
+	return nil
+}
+
+// includesKey 是作用域中保存当前包含链的内部键，用于检测循环包含和限制嵌套层数
+const includesKey = "__includes__"
+
 // includeNode 包含文件节点，用于包含其他模板文件
-type includeNode struct{ path string }
+type includeNode struct {
+	path      string   // #include 中写的路径
+	file      string   // 按照所在模板的路径解析后，相对于 Loader 根目录的路径
+	with      *program // 可选的参数表达式，需计算为 map
+	only      bool     // 为 true 时被包含的模板只能看到 with 传入的参数
+	indent    string   // 添加到被包含内容每个非空行前的缩进
+	indentOpt string   // 指令中的缩进选项：noindent 或 indent N，没有时为空
+	eol       string   // #include 指令行的换行符，被包含内容没有以换行结尾时补上
+	line      int
+}
 
 // render 渲染包含文件节点
+// 被包含的模板在第一次渲染时读取并解析，之后使用引擎中缓存的模板
 func (n *includeNode) render(sb *strings.Builder, eng *Engine, ctx map[string]any) error {
-	// Resolve include path safely
-	p := filepath.Clean(n.path)
-	b, err := fs.ReadFile(eng.Loader, p)
+	p := n.file
+	chain, _ := ctx[includesKey].([]string)
+	for _, visited := range chain {
+		if visited == p {
+			return fmt.Errorf("line %d: #include cycle: %s -> %s", n.line, strings.Join(chain, " -> "), p)
+		}
+	}
+	if depth := eng.includeDepth(); len(chain) >= depth {
+		return fmt.Errorf("line %d: #include %q: maximum include depth %d exceeded: %s -> %s", n.line, n.path, depth, strings.Join(chain, " -> "), p)
+	}
+
+	t, err := eng.include(p)
 	if err != nil {
-		return err
+		return fmt.Errorf("line %d: #include %q: %w", n.line, n.path, err)
 	}
-	t, err := eng.ParseString(string(b))
+
+	ctx, err = n.includeContext(ctx)
 	if err != nil {
-		return err
+		return lineError(n.line, err)
 	}
+	// includeContext 在没有 with 参数时直接返回调用方的作用域，渲染后恢复其中的包含链
+	prev, hadPrev := ctx[includesKey]
+	ctx[includesKey] = append(chain[:len(chain):len(chain)], p)
 	out, err := t.Render(ctx)
+	if hadPrev {
+		ctx[includesKey] = prev
+	} else {
+		delete(ctx, includesKey)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("line %d: #include %q: %w", n.line, n.path, err)
+	}
+	out = indentLines(out, n.indent)
+	if !strings.HasSuffix(out, "\n") {
+		out += n.eol
 	}
 	sb.WriteString(out)
 	return nil
+}
+
+// indentLines 在每个非空行前添加缩进
+func indentLines(s, indent string) string {
+	if indent == "" || s == "" {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	var sb strings.Builder
+	sb.Grow(len(s) + len(lines)*len(indent))
+	for _, line := range lines {
+		if line != "" && line != "\n" && line != "\r\n" {
+			sb.WriteString(indent)
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+// includeContext 计算被包含模板的上下文
+// 默认继承调用方的全部变量，with 中的参数会覆盖同名变量；指定 only 时只传入 with 中的参数
+func (n *includeNode) includeContext(ctx map[string]any) (map[string]any, error) {
+	if n.with == nil {
+		if n.only {
+			return map[string]any{}, nil
+		}
+		return ctx, nil
+	}
+
+	val, err := n.with.eval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("#include %q: %w", n.path, err)
+	}
+	params, ok := val.(map[string]any)
+	if !ok && val != nil {
+		return nil, fmt.Errorf("#include %q: with expects a map, got %T", n.path, val)
+	}
+
+	child := make(map[string]any, len(ctx)+len(params))
+	if !n.only {
+		for k, v := range ctx {
+			child[k] = v
+		}
+	}
+	for k, v := range params {
+		child[k] = v
+	}
+	return child, nil
 }
\ No newline at end of file
@@ -20,37 +20,37 @@ func TestNullSafetyOperator(t *testing.T) {
 			name:     "基本空安全运算符 - 值存在",
 			template: "Name: ${name ?? 'Anonymous'}",
 			context:  map[string]any{"name": "张三"},
-			expected: "Name: 张三\n",
+			expected: "Name: 张三",
 		},
 		{
 			name:     "基本空安全运算符 - 值不存在",
 			template: "Name: ${name ?? 'Anonymous'}",
 			context:  map[string]any{},
-			expected: "Name: Anonymous\n",
+			expected: "Name: Anonymous",
 		},
 		{
 			name:     "空安全运算符 - nil值",
 			template: "Value: ${value ?? 'Default'}",
 			context:  map[string]any{"value": nil},
-			expected: "Value: Default\n",
+			expected: "Value: Default",
 		},
 		{
 			name:     "空安全运算符 - 空字符串",
 			template: "Text: ${text ?? 'No text'}",
 			context:  map[string]any{"text": ""},
-			expected: "Text: No text\n",
+			expected: "Text: No text",
 		},
 		{
 			name:     "空安全运算符 - 零值数字",
 			template: "Count: ${count ?? 10}",
 			context:  map[string]any{"count": 0},
-			expected: "Count: 0\n", // 零值不被认为是空值
+			expected: "Count: 0", // 零值不被认为是空值
 		},
 		{
 			name:     "空安全运算符 - false值",
 			template: "Enabled: ${enabled ?? true}",
 			context:  map[string]any{"enabled": false},
-			expected: "Enabled: false\n", // false不被认为是空值
+			expected: "Enabled: false", // false不被认为是空值
 		},
 		{
 			name:     "嵌套对象空安全运算符",
@@ -61,7 +61,7 @@ func TestNullSafetyOperator(t *testing.T) {
 					// 故意省略email字段
 				},
 			},
-			expected: "Email: no-email@example.com\n",
+			expected: "Email: no-email@example.com",
 		},
 		{
 			name:     "多层嵌套空安全运算符",
@@ -72,13 +72,13 @@ func TestNullSafetyOperator(t *testing.T) {
 					// 故意省略profile字段
 				},
 			},
-			expected: "Address: No address\n",
+			expected: "Address: No address",
 		},
 		{
 			name:     "数组索引空安全运算符",
 			template: "First item: ${items[0] ?? 'No items'}",
 			context:  map[string]any{"items": []string{}},
-			expected: "First item: No items\n",
+			expected: "First item: No items",
 		},
 		{
 			name:     "链式空安全运算符",
@@ -88,7 +88,7 @@ func TestNullSafetyOperator(t *testing.T) {
 				"b": "",
 				"c": nil,
 			},
-			expected: "Value: Final default\n",
+			expected: "Value: Final default",
 		},
 		{
 			name:     "链式空安全运算符 - 中间有值",
@@ -98,13 +98,13 @@ func TestNullSafetyOperator(t *testing.T) {
 				"b": "Found!",
 				"c": "Should not reach",
 			},
-			expected: "Value: Found!\n",
+			expected: "Value: Found!",
 		},
 		{
 			name:     "空安全运算符与表达式",
 			template: "Result: ${(value * 2) ?? 0}",
 			context:  map[string]any{"value": 5},
-			expected: "Result: 10\n",
+			expected: "Result: 10",
 		},
 		{
 			name:     "空安全运算符与字符串连接",
@@ -113,7 +113,7 @@ func TestNullSafetyOperator(t *testing.T) {
 				"firstName": "John",
 				"lastName":  "Doe",
 			},
-			expected: "Full name: John Doe\n",
+			expected: "Full name: John Doe",
 		},
 	}
 
@@ -263,25 +263,25 @@ func TestNullSafetyEdgeCases(t *testing.T) {
 			name:     "空安全运算符与数字零值",
 			template: "Count: ${count ?? -1}",
 			context:  map[string]any{"count": 0},
-			expected: "Count: 0\n", // 零值不被认为是空值
+			expected: "Count: 0", // 零值不被认为是空值
 		},
 		{
 			name:     "空安全运算符与布尔false",
 			template: "Enabled: ${enabled ?? true}",
 			context:  map[string]any{"enabled": false},
-			expected: "Enabled: false\n", // false不被认为是空值
+			expected: "Enabled: false", // false不被认为是空值
 		},
 		{
 			name:     "空安全运算符与空数组",
 			template: "Items: ${items ?? 'No items'}",
 			context:  map[string]any{"items": []string{}},
-			expected: "Items: []\n", // 空数组不被认为是空值
+			expected: "Items: []", // 空数组不被认为是空值
 		},
 		{
 			name:     "空安全运算符与空Map",
 			template: "Config: ${config ?? 'No config'}",
 			context:  map[string]any{"config": map[string]any{}},
-			expected: "Config: map[]\n", // 空Map不被认为是空值
+			expected: "Config: map[]", // 空Map不被认为是空值
 		},
 		{
 			name:     "简单空安全运算符链",
@@ -290,7 +290,7 @@ func TestNullSafetyEdgeCases(t *testing.T) {
 				"a": nil,
 				"b": "found",
 			},
-			expected: "Result: found\n",
+			expected: "Result: found",
 		},
 		{
 			name:     "多层空安全运算符",
@@ -299,7 +299,7 @@ func TestNullSafetyEdgeCases(t *testing.T) {
 				"x": nil,
 				"y": "success",
 			},
-			expected: "Value: success\n",
+			expected: "Value: success",
 		},
 	}
 
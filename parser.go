@@ -1,246 +1,1063 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 // parser 模板解析器
 type parser struct {
-	lines  []string
-	cursor int
+	eng     *Engine  // 提供表达式缓存
+	syn     *syntax  // 指令前缀和表达式分隔符
+	path    string   // 模板路径，用于解析 #include 中的相对路径；ParseString 解析的模板为空
+	lines   []string // 逻辑行：续行和跨行表达式已合并
+	lineNos []int    // 每个逻辑行在源码中的起始行号（从 1 开始）
+	eols    []string // 每个逻辑行的换行符：\n、\r\n 或空字符串（源码最后一行没有换行）
+	cursor  int
+	macros  map[string]*macroNode // #define 定义的宏，按名称索引
+	loops   int                   // 当前所在 #for 循环体的嵌套层数，用于校验 #break / #continue
+
+	// 模板继承
+	extends     string                // #extends 指定的父模板路径
+	extendsLine int                   // #extends 所在行号
+	blocks      map[string]*blockNode // #block 定义的可覆盖区域，按名称索引
+
+	// 空白控制状态，按源码顺序作用于相邻的文本节点
+	tail     []*textNode // 最近生成的连续文本节点，供 #-xxx 和 ${- ...} 向前裁剪空白
+	trimNext bool        // 为 true 时裁剪之后生成的文本开头的空白
 }
 
-// newParser 创建新的模板解析器
-func newParser(s string) *parser {
-	// Normalize line endings
-	s = strings.ReplaceAll(s, "\r\n", "\n")
-	return &parser{lines: strings.Split(s, "\n")}
+// newParser 创建新的模板解析器，使用引擎的语法、换行符设置和表达式缓存
+// 默认保留每行原有的换行符（\n 或 \r\n）以及源码末尾是否有换行；
+// 引擎设置了 WithNormalizedNewlines 时统一使用 \n，并且每行（包括最后一行）都以 \n 结尾
+func newParser(s string, eng *Engine) *parser {
+	syn := eng.syn()
+	physical, eols := splitPhysicalLines(s, eng.normalizeNewlines)
+	lines, lineNos, eols := syn.joinLines(physical, eols)
+	return &parser{eng: eng, syn: syn, lines: lines, lineNos: lineNos, eols: eols, macros: map[string]*macroNode{}, blocks: map[string]*blockNode{}}
 }
 
-// 正则表达式模式
-var (
-	reIf      = regexp.MustCompile(`^\s*#if\s+(.+)$`)
-	reElse    = regexp.MustCompile(`^\s*#else\s*$`)
-	reEnd     = regexp.MustCompile(`^\s*#end\s*$`)
-	reFor     = regexp.MustCompile(`^\s*#for\s+([a-zA-Z_][a-zA-Z0-9_]*(?:\s*,\s*[a-zA-Z_][a-zA-Z0-9_]*)?)\s+in\s+(.+)$`)
-	reInclude = regexp.MustCompile(`^\s*#include\s+"([^"]+)"\s*$`)
-)
+// splitPhysicalLines 将源码切分为物理行（不含换行符）和每行的换行符，
+// 源码末尾没有换行时最后一行的换行符为空字符串
+func splitPhysicalLines(s string, normalize bool) (lines, eols []string) {
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			eols = append(eols, "")
+			break
+		}
+		line, eol := s[:i], "\n"
+		if strings.HasSuffix(line, "\r") {
+			line = line[:len(line)-1]
+			if !normalize {
+				eol = "\r\n"
+			}
+		}
+		lines = append(lines, line)
+		eols = append(eols, eol)
+		s = s[i+1:]
+	}
+	if normalize && len(eols) > 0 {
+		eols[len(eols)-1] = "\n"
+	}
+	return lines, eols
+}
 
-// parse 解析模板内容
-func (p *parser) parse() ([]node, error) {
-	var nodes []node
-	for p.cursor < len(p.lines) {
-		line := p.lines[p.cursor]
+// joinLines 将物理行合并为逻辑行，并记录每个逻辑行的起始行号
+//   - #raw 块内的行保持原样
+//   - 删除模板注释
+//   - 以反斜杠结尾的指令行与下一行合并，例如较长的 #if 条件
+//   - 包含未闭合 ${ 或 #( 的行与后续行合并，直到表达式闭合；到下一个指令行或文件末尾仍未闭合时解析报错
+//
+// 逻辑行的换行符取其最后一个物理行的换行符
+func (s *syntax) joinLines(physical, physicalEOLs []string) (lines []string, lineNos []int, eols []string) {
+	lastClose := -2 // 最后一个包含注释块结束标记的物理行，在第一次遇到注释块时计算
+	for i := 0; i < len(physical); i++ {
+		start := i
+		line := physical[i]
 
-		// Directive: #if
-		if m := reIf.FindStringSubmatch(line); m != nil {
-			p.cursor++
-			thenBlock, elseBlock, err := p.parseIfBlocks(m[1])
-			if err != nil {
-				return nil, err
+		// #raw 块内的行原样保留，不处理注释和续行
+		if s.mayBeDirective(line) && s.reRawStart.MatchString(line) {
+			lines = append(lines, line)
+			lineNos = append(lineNos, start+1)
+			eols = append(eols, physicalEOLs[i])
+			for i+1 < len(physical) {
+				i++
+				lines = append(lines, physical[i])
+				lineNos = append(lineNos, i+1)
+				eols = append(eols, physicalEOLs[i])
+				if s.reRawEnd.MatchString(physical[i]) {
+					break
+				}
 			}
-			nodes = append(nodes, &ifNode{cond: m[1], thenN: thenBlock, elseN: elseBlock})
 			continue
 		}
 
-		// Directive: #for x in expr 或 #for key, value in expr
-		if m := reFor.FindStringSubmatch(line); m != nil {
-			p.cursor++
-			body, err := p.parseUntilEnd()
-			if err != nil {
-				return nil, err
+		// 模板注释：#-- 注释行整行丢弃，#* ... *# 注释块（可以跨行）被删除，删除后只剩空白的行整行丢弃
+		if s.mayBeDirective(line) && s.reLineComment.MatchString(line) {
+			continue
+		}
+		if s.commentOpenAt(line, 0) >= 0 {
+			if lastClose < -1 {
+				lastClose = s.lastCommentEnd(physical)
 			}
-			
-			// 解析变量名，支持 key, value 语法
-			vars := strings.Split(m[1], ",")
-			var varName, varName2 string
-			if len(vars) == 1 {
-				varName = strings.TrimSpace(vars[0])
-			} else if len(vars) == 2 {
-				varName = strings.TrimSpace(vars[0])
-				varName2 = strings.TrimSpace(vars[1])
+			if stripped, j, ok := s.stripComments(physical, i, lastClose); ok {
+				i = j
+				if strings.TrimSpace(stripped) == "" {
+					continue
+				}
+				line = stripped
+			}
+		}
+
+		if s.mayBeDirective(line) && s.reDirectiveStart.MatchString(line) {
+			for i+1 < len(physical) {
+				trimmed := strings.TrimRight(line, " \t")
+				if !strings.HasSuffix(trimmed, "\\") {
+					break
+				}
+				i++
+				line = trimmed[:len(trimmed)-1] + " " + strings.TrimLeft(physical[i], " \t")
+			}
+		} else if sc := (exprScanner{syn: s}); sc.scan(line) {
+			// 逐行继续扫描，遇到下一个指令行时停止，保证每个物理行只扫描一次；
+			// 仍未闭合时同样合并扫描过的行，由 splitExprs 报告第一个未闭合的表达式及其行号
+			j := i + 1
+			for ; j < len(physical) && !(s.mayBeDirective(physical[j]) && s.reDirectiveStart.MatchString(physical[j])); j++ {
+				if !sc.scan("\n" + physical[j]) {
+					j++
+					break
+				}
+			}
+			if j > i+1 {
+				line, i = line+"\n"+strings.Join(physical[i+1:j], "\n"), j-1
+			}
+		}
+
+		lines = append(lines, line)
+		lineNos = append(lineNos, start+1)
+		eols = append(eols, physicalEOLs[i])
+	}
+	return lines, lineNos, eols
+}
+
+// commentOpenAt 返回 text 中从 from 开始的第一个注释块起始标记的位置，没有时返回 -1
+// 只有位于行首或空白之后的 #* 才开始注释，例如 Shell 的 ${f##*/} 中的 #* 不是注释
+func (s *syntax) commentOpenAt(text string, from int) int {
+	for {
+		i := strings.Index(text[from:], s.commentStart)
+		if i < 0 {
+			return -1
+		}
+		i += from
+		if i == 0 || text[i-1] == ' ' || text[i-1] == '\t' {
+			return i
+		}
+		from = i + 1
+	}
+}
+
+// lastCommentEnd 返回最后一个包含注释块结束标记的物理行，没有时返回 -1
+func (s *syntax) lastCommentEnd(physical []string) int {
+	for i := len(physical) - 1; i >= 0; i-- {
+		if strings.Contains(physical[i], s.commentEnd) {
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComments 从 physical[i] 开始删除 #* ... *# 注释块，注释块可以跨行
+// 返回删除注释后的文本和最后一个被合并的物理行；lastClose 为最后一个包含结束标记的物理行，
+// 注释块在它之后仍未闭合时直接返回 ok 为 false，调用方保留原行，每行最多只扫描一次
+func (s *syntax) stripComments(physical []string, i, lastClose int) (text string, last int, ok bool) {
+	var sb strings.Builder
+	line, pos := physical[i], 0
+	for {
+		open := s.commentOpenAt(line, pos)
+		if open < 0 {
+			sb.WriteString(line[pos:])
+			return sb.String(), i, true
+		}
+		sb.WriteString(line[pos:open])
+		from := open + len(s.commentStart)
+		for {
+			if j := strings.Index(line[from:], s.commentEnd); j >= 0 {
+				pos = from + j + len(s.commentEnd)
+				break
+			}
+			if i >= lastClose {
+				return "", 0, false
+			}
+			i++
+			line, from = physical[i], 0
+		}
+	}
+}
+
+// exprOpenAt 判断 text[i:] 是否以表达式起始分隔符（${ 或 #(）开头，
+// 返回起始分隔符的长度和对应的结束分隔符，不是起始分隔符时返回 0
+func (s *syntax) exprOpenAt(text string, i int) (int, string) {
+	switch {
+	case strings.HasPrefix(text[i:], s.open):
+		return len(s.open), s.close
+	case strings.HasPrefix(text[i:], s.hashOpen):
+		return len(s.hashOpen), ")"
+	}
+	return 0, ""
+}
+
+// exprScanner 逐段扫描文本，判断其中是否存在没有闭合的 ${ 或 #( 表达式
+// 扫描时会跳过字符串字面量和嵌套的括号，转义的 \${ 和 \#( 不计入；
+// 未闭合表达式的嵌套层数和引号状态在多次 scan 之间保留，跨行的表达式不需要重新扫描前面的行
+type exprScanner struct {
+	syn    *syntax
+	closer string // 当前未闭合表达式的结束分隔符，为空表示不在表达式中
+	depth  int    // 表达式中未闭合的括号层数
+	quote  byte   // 表达式中未闭合的字符串字面量的引号
+	escape bool   // 字符串字面量中上一个字符是反斜杠
+}
+
+// scan 继续扫描一段文本，返回扫描后是否仍处于未闭合的表达式中
+func (sc *exprScanner) scan(text string) bool {
+	s := sc.syn
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if sc.closer == "" {
+			if c == '\\' {
+				if s.escapedBackslashAt(text, i) {
+					i++
+				} else if n, _ := s.exprOpenAt(text, i+1); n > 0 {
+					i += n
+				}
+				continue
+			}
+			if c != s.open[0] && c != s.hashOpen[0] {
+				continue
+			}
+			if n, closer := s.exprOpenAt(text, i); n > 0 {
+				sc.closer = closer
+				i += n - 1
 			}
-			
-			nodes = append(nodes, &forNode{varName: varName, varName2: varName2, iter: m[2], body: body})
 			continue
 		}
+		switch {
+		case sc.escape:
+			sc.escape = false
+		case sc.quote != 0:
+			if c == '\\' {
+				sc.escape = true
+			} else if c == sc.quote {
+				sc.quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			sc.quote = c
+		case sc.depth == 0 && c == sc.closer[0] && strings.HasPrefix(text[i:], sc.closer):
+			i += len(sc.closer) - 1
+			sc.closer = ""
+		case c == '(' || c == '[' || c == '{':
+			sc.depth++
+		case c == ')' || c == ']' || c == '}':
+			sc.depth--
+		}
+	}
+	return sc.closer != ""
+}
+
+// escapedBackslashAt 判断 text[i:] 是否为两个反斜杠加表达式起始分隔符，即转义的反斜杠
+func (s *syntax) escapedBackslashAt(text string, i int) bool {
+	if i+1 >= len(text) || text[i] != '\\' || text[i+1] != '\\' {
+		return false
+	}
+	n, _ := s.exprOpenAt(text, i+2)
+	return n > 0
+}
+
+// matchClose 从 start 开始查找与起始分隔符配对的结束分隔符，返回其位置，找不到时返回 -1
+// 字符串字面量中的字符和嵌套括号内的结束分隔符会被忽略
+func matchClose(s string, start int, closer string) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case depth == 0 && c == closer[0] && strings.HasPrefix(s[i:], closer):
+			return i
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		}
+	}
+	return -1
+}
+
+// compile 编译表达式，相同源码的表达式在同一个引擎中只编译一次
+func (p *parser) compile(code string) *program {
+	return p.eng.compile(code)
+}
+
+// compileOptional 编译可选的表达式，源码为空时返回 nil
+func (p *parser) compileOptional(code string) *program {
+	if code == "" {
+		return nil
+	}
+	return p.compile(code)
+}
+
+// compileAll 编译表达式列表
+func (p *parser) compileAll(codes []string) []*program {
+	progs := make([]*program, len(codes))
+	for i, code := range codes {
+		progs[i] = p.compile(code)
+	}
+	return progs
+}
+
+// lineNo 返回游标所在逻辑行的起始行号
+func (p *parser) lineNo() int {
+	return p.lineNos[p.cursor]
+}
+
+// parse 解析模板内容
+func (p *parser) parse() ([]node, error) {
+	var nodes []node
+	for p.cursor < len(p.lines) {
+		line := p.current()
 
-		// Directive: #include "file"
-		if m := reInclude.FindStringSubmatch(line); m != nil {
+		// #extends 只能出现在模板顶层
+		if m := p.syn.reExtends.FindStringSubmatch(line); m != nil {
+			if p.extends != "" {
+				return nil, fmt.Errorf("line %d: #extends: template already extends %q", p.lineNo(), p.extends)
+			}
+			p.extends, p.extendsLine = m[1], p.lineNo()
 			p.cursor++
-			nodes = append(nodes, &includeNode{path: m[1]})
+			continue
+		}
+
+		// Directives: #if / #for / #switch / #include / #define / #call / #raw / #block
+		n, ok, err := p.parseDirective(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			nodes = append(nodes, n)
 			continue
 		}
 
 		// Plain line (may contain expressions)
+		parts, err := p.splitLine(line)
+		if err != nil {
+			return nil, err
+		}
 		p.cursor++
-		parts := splitExprs(line)
 		nodes = append(nodes, parts...)
 	}
 	return nodes, nil
 }
 
-// parseIfBlocks 解析 if 块
-func (p *parser) parseIfBlocks(cond string) (thenBlock, elseBlock []node, err error) {
-	thenBlock = []node{}
+// maxIncludeIndent #include 的 indent N 允许的最大缩进宽度
+const maxIncludeIndent = 256
+
+// parseDirective 尝试将当前行解析为块指令或单行指令
+// 如果该行不是指令，返回 ok=false 且不移动游标
+func (p *parser) parseDirective(line string) (n node, ok bool, err error) {
+	if !p.syn.mayBeDirective(line) {
+		return nil, false, nil
+	}
+	start := p.lineNo()
+
+	// Directive: #if
+	if m := p.syn.reIf.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		n, err := p.parseIfBlocks(m[1], start)
+		if err != nil {
+			return nil, false, err
+		}
+		return n, true, nil
+	}
+
+	// Directive: #for x in expr 或 #for key, value in expr
+	if m := p.syn.reFor.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		body, elseBody, elseLine, err := p.parseForBlocks(start)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// 解析变量名，支持 key, value 语法
+		vars := strings.Split(m[1], ",")
+		var varName, varName2 string
+		if len(vars) == 1 {
+			varName = strings.TrimSpace(vars[0])
+		} else if len(vars) == 2 {
+			varName = strings.TrimSpace(vars[0])
+			varName2 = strings.TrimSpace(vars[1])
+		}
+
+		n := &forNode{varName: varName, varName2: varName2, body: body, elseN: elseBody, elseLine: elseLine, line: start}
+		iter, filter, sorted, reversed := parseForClause(m[2])
+		n.iter, n.filter, n.sorted, n.reversed = p.compile(iter), p.compileOptional(filter), sorted, reversed
+		return n, true, nil
+	}
+
+	// Directive: #include "file" [with expr] [only] [noindent | indent N]
+	if m := p.syn.reInclude.FindStringSubmatch(line); m != nil {
+		eol := p.eols[p.cursor]
+		p.cursor++
+		// 默认按照指令所在列缩进被包含的内容
+		indent, indentOpt := m[1], ""
+		if m[5] != "" {
+			indent, indentOpt = "", "noindent"
+		} else if m[6] != "" {
+			width, err := strconv.Atoi(m[6])
+			if err != nil || width > maxIncludeIndent {
+				return nil, false, fmt.Errorf("line %d: #include: invalid indent %s, expected at most %d", start, m[6], maxIncludeIndent)
+			}
+			indent, indentOpt = strings.Repeat(" ", width), "indent "+strconv.Itoa(width)
+		}
+		p.tail = nil
+		return &includeNode{path: m[2], file: resolvePath(p.path, m[2]), with: p.compileOptional(m[3]), only: m[4] != "",
+			indent: indent, indentOpt: indentOpt, eol: eol, line: start}, true, nil
+	}
+
+	// Directive: #define name(a, b) ... #end
+	if m := p.syn.reDefine.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		if _, exists := p.macros[m[1]]; exists {
+			return nil, false, fmt.Errorf("line %d: #define: macro %q already defined", start, m[1])
+		}
+		// 宏体不属于外层循环，其中不能使用 #break / #continue
+		loops := p.loops
+		p.loops = 0
+		body, err := p.parseUntilEnd("#define", start)
+		p.loops = loops
+		if err != nil {
+			return nil, false, err
+		}
+		var params []string
+		if strings.TrimSpace(m[2]) != "" {
+			for _, param := range strings.Split(m[2], ",") {
+				params = append(params, strings.TrimSpace(param))
+			}
+		}
+		mn := &macroNode{name: m[1], params: params, body: body, line: start}
+		p.macros[mn.name] = mn
+		return mn, true, nil
+	}
+
+	// Directive: #set name = expr 或 #let name = expr
+	if m := p.syn.reSet.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		return &setNode{name: m[1], value: p.compile(strings.TrimSpace(m[2])), line: start}, true, nil
+	}
+
+	// Directive: #break [if expr] 或 #continue [if expr]
+	if m := p.syn.reLoopCtl.FindStringSubmatch(line); m != nil {
+		if p.loops == 0 {
+			return nil, false, fmt.Errorf("line %d: #%s outside of #for", start, m[1])
+		}
+		p.cursor++
+		return &loopCtlNode{brk: m[1] == "break", cond: p.compileOptional(m[2]), line: start}, true, nil
+	}
+
+	// Directive: #switch expr ... #case v1, v2 ... #default ... #end
+	if m := p.syn.reSwitch.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		n, err := p.parseSwitchBlocks(m[1], start)
+		if err != nil {
+			return nil, false, err
+		}
+		return n, true, nil
+	}
+
+	// Directive: #block name ... #end
+	if m := p.syn.reBlock.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		if _, exists := p.blocks[m[1]]; exists {
+			return nil, false, fmt.Errorf("line %d: #block: block %q already defined", start, m[1])
+		}
+		body, err := p.parseUntilEnd("#block", start)
+		if err != nil {
+			return nil, false, err
+		}
+		bn := &blockNode{name: m[1], body: body, line: start}
+		p.blocks[bn.name] = bn
+		return bn, true, nil
+	}
+
+	// #extends 出现在块内部
+	if p.syn.reExtends.MatchString(line) {
+		return nil, false, fmt.Errorf("line %d: #extends must be at the top level of a template", start)
+	}
+
+	// Directive: #raw ... #end 或 #verbatim ... #end
+	if p.syn.reRaw.MatchString(line) {
+		p.cursor++
+		return p.parseRaw(start)
+	}
+
+	// Directive: #call name(expr, expr)
+	if m := p.syn.reCall.FindStringSubmatch(line); m != nil {
+		p.cursor++
+		p.tail = nil
+		return &callNode{name: m[1], args: p.compileAll(splitTopLevel(m[2], ',')), line: start}, true, nil
+	}
+
+	return nil, false, p.checkDirective(line, start)
+}
+
+// strayDirectives 只能出现在特定块内部的指令，出现在其他位置时的错误说明
+var strayDirectives = []struct {
+	keyword string
+	reason  string
+}{
+	{"end", "without an open block"},
+	{"else", "without #if or #for"},
+	{"elif", "without #if"},
+	{"case", "outside of #switch"},
+	{"default", "outside of #switch"},
+}
+
+// directiveUsage 各指令的正确写法，用于格式错误的提示
+var directiveUsage = map[string]string{
+	"if":       `#if expr`,
+	"elif":     `#elif expr`,
+	"else":     `#else`,
+	"end":      `#end`,
+	"for":      `#for x in expr`,
+	"include":  `#include "file" [with expr] [only] [noindent | indent N]`,
+	"define":   `#define name(a, b)`,
+	"set":      `#set name = expr`,
+	"let":      `#let name = expr`,
+	"break":    `#break [if expr]`,
+	"continue": `#continue [if expr]`,
+	"call":     `#call name(expr, ...)`,
+	"raw":      `#raw`,
+	"verbatim": `#verbatim`,
+	"extends":  `#extends "file"`,
+	"block":    `#block name`,
+	"switch":   `#switch expr`,
+	"case":     `#case expr, ...`,
+	"default":  `#default`,
+}
+
+// directiveAliases 其他模板语言中常见的指令写法及其对应的指令
+var directiveAliases = map[string]string{
+	"fi":        "end",
+	"done":      "end",
+	"esac":      "end",
+	"endif":     "end",
+	"endfor":    "end",
+	"endswitch": "end",
+	"endblock":  "end",
+	"enddefine": "end",
+	"endmacro":  "end",
+	"endraw":    "end",
+	"elsif":     "elif",
+	"elseif":    "elif",
+	"foreach":   "for",
+	"each":      "for",
+	"macro":     "define",
+	"import":    "include",
+}
+
+// checkDirective 检查没有匹配任何指令的行是否是写错的指令
+//   - 只能出现在块内部的 #end / #else / #elif / #case / #default
+//   - 指令关键字正确但格式错误，例如 `#for x of xs`、`#include file.yaml`
+//   - 其他模板语言的写法，例如 `#fi`、`#endif`，换成对应的指令后是一条完整的指令时报错并给出该指令
+//
+// 关键字区分大小写，其他以 # 开头的行（例如 `# comment`、`#!/bin/bash`、`#Set replicas here`、
+// `#import stuff`）仍然作为普通文本
+func (p *parser) checkDirective(line string, lineNo int) error {
+	s := p.syn
+	for _, d := range strayDirectives {
+		if s.keywordPatterns[d.keyword].MatchString(line) {
+			return fmt.Errorf("line %d: unexpected %s%s %s", lineNo, s.prefix, d.keyword, d.reason)
+		}
+	}
+
+	m := s.reDirectiveWord.FindStringSubmatchIndex(line)
+	if m == nil {
+		return nil
+	}
+	word := line[m[2]:m[3]]
+	if usage, ok := directiveUsage[word]; ok {
+		return fmt.Errorf("line %d: malformed %s%s directive, expected %q", lineNo, s.prefix, word, s.prefix+usage[1:])
+	}
+	// 去掉空白控制标记后将别名换成对应的关键字，只有得到完整的指令时才认为是写错的指令
+	if alias, ok := directiveAliases[word]; ok && s.isDirectiveLine(strings.TrimSuffix(line[:m[2]], "-")+alias+line[m[3]:]) {
+		return fmt.Errorf("line %d: unknown directive %q, did you mean %q?", lineNo, s.prefix+word, s.prefix+alias)
+	}
+	return nil
+}
+
+// parseRaw 解析 #raw 块，块内直到第一个 #end 的所有行作为一个文本节点原样输出
+func (p *parser) parseRaw(start int) (node, bool, error) {
+	var sb strings.Builder
+	first := p.lineNo()
 	for p.cursor < len(p.lines) {
-		line := p.lines[p.cursor]
+		if p.syn.reRawEnd.MatchString(p.lines[p.cursor]) {
+			n := &textNode{text: sb.String(), line: first}
+			if p.trimNext {
+				n.text = strings.TrimLeft(n.text, " \t\r\n")
+				p.trimNext = n.text == ""
+			}
+			p.tail = append(p.tail, n)
+			// 处理 #end 上的空白控制标记
+			p.current()
+			p.cursor++
+			return n, true, nil
+		}
+		sb.WriteString(p.lines[p.cursor])
+		sb.WriteString(p.eols[p.cursor])
+		p.cursor++
+	}
+	return nil, false, fmt.Errorf("line %d: unterminated #raw: missing #end", start)
+}
 
-		if reEnd.MatchString(line) {
+// 空白控制标记：指令名前的 `#-` 裁剪指令之前的空白（包括换行），
+// 指令行末尾的 ` -` 裁剪指令之后的空白
+var reTrimRightMarker = regexp.MustCompile(`^(.*\S)\s+-\s*$`)
+
+// current 返回游标所在的行
+// 如果是带空白控制标记的指令行，返回去掉标记后的指令，并对相邻文本执行裁剪
+func (p *parser) current() string {
+	line := p.lines[p.cursor]
+	if !p.syn.mayBeDirective(line) {
+		return line
+	}
+
+	stripped := line
+	trimLeft, trimRight := false, false
+	if m := p.syn.reTrimLeftMarker.FindStringSubmatchIndex(stripped); m != nil {
+		stripped = stripped[:m[3]] + p.syn.prefix + stripped[m[4]:]
+		trimLeft = true
+	}
+	if m := reTrimRightMarker.FindStringSubmatch(stripped); m != nil && p.syn.isDirectiveLine(m[1]) {
+		stripped = m[1]
+		trimRight = true
+	}
+	if (!trimLeft && !trimRight) || !p.syn.isDirectiveLine(stripped) {
+		return line
+	}
+
+	if trimLeft {
+		p.trimTail()
+	}
+	if trimRight {
+		p.trimNext = true
+	}
+	return stripped
+}
+
+// trimTail 向前裁剪最近生成的文本节点末尾的空白
+func (p *parser) trimTail() {
+	for i := len(p.tail) - 1; i >= 0; i-- {
+		p.tail[i].text = strings.TrimRight(p.tail[i].text, " \t\r\n")
+		if p.tail[i].text != "" {
+			break
+		}
+	}
+}
+
+// splitLine 将普通行拆分为节点，并处理表达式上的空白控制标记
+// 以 ## 加指令关键字开头的行是转义的指令，去掉一个 # 后按普通文本输出
+func (p *parser) splitLine(line string) ([]node, error) {
+	if p.syn.mayBeDirective(line) {
+		if m := p.syn.reEscapedDirective.FindStringSubmatchIndex(line); m != nil {
+			line = line[:m[3]] + line[m[4]:]
+		}
+	}
+	nodes, err := p.syn.splitExprs(line, p.eols[p.cursor], p.lineNo())
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *textNode:
+			if p.trimNext {
+				n.text = strings.TrimLeft(n.text, " \t\r\n")
+				p.trimNext = n.text == ""
+			}
+			p.tail = append(p.tail, n)
+		case *exprNode:
+			n.prog = p.compile(n.code)
+			if n.trimLeft {
+				p.trimTail()
+			}
+			p.tail = nil
+			p.trimNext = n.trimRight
+		}
+	}
+	return nodes, nil
+}
+
+// parseIfBlocks 解析 if 块，包括任意数量的 #elif / #else if 分支和可选的 #else 分支
+func (p *parser) parseIfBlocks(cond string, start int) (*ifNode, error) {
+	n := &ifNode{cond: p.compile(cond), thenN: []node{}, line: start}
+	block := &n.thenN
+	for p.cursor < len(p.lines) {
+		line := p.current()
+
+		if p.syn.reEnd.MatchString(line) {
 			p.cursor++
-			return thenBlock, elseBlock, nil
+			return n, nil
 		}
-		if reElse.MatchString(line) {
+		if m := p.syn.reElif.FindStringSubmatch(line); m != nil {
+			n.elifs = append(n.elifs, elifBranch{cond: p.compile(m[1]), body: []node{}, line: p.lineNo()})
 			p.cursor++
-			elseBlock, err = p.parseUntilEnd()
-			return thenBlock, elseBlock, err
+			block = &n.elifs[len(n.elifs)-1].body
+			continue
 		}
-
-		// Nested directives are supported via re-parse of line kinds
-		if m := reIf.FindStringSubmatch(line); m != nil {
+		if p.syn.reElse.MatchString(line) {
+			n.elseLine = p.lineNo()
 			p.cursor++
-			th, el, err := p.parseIfBlocks(m[1])
+			elseBlock, err := p.parseUntilEnd("#if", start)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
-			thenBlock = append(thenBlock, &ifNode{cond: m[1], thenN: th, elseN: el})
+			n.elseN = elseBlock
+			return n, nil
+		}
+
+		// Nested directives are supported via re-parse of line kinds
+		nested, ok, err := p.parseDirective(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			*block = append(*block, nested)
 			continue
 		}
-		if m := reFor.FindStringSubmatch(line); m != nil {
+
+		parts, err := p.splitLine(line)
+		if err != nil {
+			return nil, err
+		}
+		p.cursor++
+		*block = append(*block, parts...)
+	}
+	return nil, fmt.Errorf("line %d: unterminated #if: missing #end", start)
+}
+
+// parseSwitchBlocks 解析 switch 块中的 #case 分支和可选的 #default 分支
+// #switch 与第一个 #case 之间只允许空行
+func (p *parser) parseSwitchBlocks(subject string, start int) (*switchNode, error) {
+	n := &switchNode{subject: p.compile(subject), line: start}
+	var block *[]node
+	for p.cursor < len(p.lines) {
+		line := p.current()
+
+		if p.syn.reEnd.MatchString(line) {
 			p.cursor++
-			body, err := p.parseUntilEnd()
-			if err != nil {
-				return nil, nil, err
+			return n, nil
+		}
+		if m := p.syn.reCase.FindStringSubmatch(line); m != nil {
+			if n.defaultLine > 0 {
+				return nil, fmt.Errorf("line %d: #case after #default", p.lineNo())
 			}
-			
-			// 解析变量名，支持 key, value 语法
-			vars := strings.Split(m[1], ",")
-			var varName, varName2 string
-			if len(vars) == 1 {
-				varName = strings.TrimSpace(vars[0])
-			} else if len(vars) == 2 {
-				varName = strings.TrimSpace(vars[0])
-				varName2 = strings.TrimSpace(vars[1])
+			n.cases = append(n.cases, switchCase{values: p.compileAll(splitTopLevel(m[1], ',')), body: []node{}, line: p.lineNo()})
+			p.cursor++
+			block = &n.cases[len(n.cases)-1].body
+			continue
+		}
+		if p.syn.reDefault.MatchString(line) {
+			if n.defaultLine > 0 {
+				return nil, fmt.Errorf("line %d: duplicate #default in #switch", p.lineNo())
 			}
-			
-			thenBlock = append(thenBlock, &forNode{varName: varName, varName2: varName2, iter: m[2], body: body})
+			n.defaultLine = p.lineNo()
+			n.defaultN = []node{}
+			p.cursor++
+			block = &n.defaultN
 			continue
 		}
-		if m := reInclude.FindStringSubmatch(line); m != nil {
+
+		if block == nil {
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("line %d: #switch: expected #case or #default", p.lineNo())
+			}
 			p.cursor++
-			thenBlock = append(thenBlock, &includeNode{path: m[1]})
 			continue
 		}
 
+		nested, ok, err := p.parseDirective(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			*block = append(*block, nested)
+			continue
+		}
+
+		parts, err := p.splitLine(line)
+		if err != nil {
+			return nil, err
+		}
 		p.cursor++
-		parts := splitExprs(line)
-		thenBlock = append(thenBlock, parts...)
+		*block = append(*block, parts...)
 	}
-	return nil, nil, errors.New("unterminated #if: missing #end")
+	return nil, fmt.Errorf("line %d: unterminated #switch: missing #end", start)
 }
 
-// parseUntilEnd 解析直到遇到 #end
-func (p *parser) parseUntilEnd() ([]node, error) {
-	var nodes []node
+// parseForBlocks 解析 for 循环体和可选的 #else 分支
+// elseLine 为 #else 所在行号，没有 #else 分支时为 0
+func (p *parser) parseForBlocks(start int) (body, elseBody []node, elseLine int, err error) {
+	p.loops++
+	defer func() { p.loops-- }()
 	for p.cursor < len(p.lines) {
-		line := p.lines[p.cursor]
-		if reEnd.MatchString(line) {
+		line := p.current()
+
+		if p.syn.reEnd.MatchString(line) {
 			p.cursor++
-			return nodes, nil
+			return body, nil, 0, nil
 		}
-		// nested
-		if m := reIf.FindStringSubmatch(line); m != nil {
+		if p.syn.reElse.MatchString(line) {
+			elseLine = p.lineNo()
 			p.cursor++
-			th, el, err := p.parseIfBlocks(m[1])
+			// #else 分支在循环之外执行
+			p.loops--
+			elseBody, err = p.parseUntilEnd("#for", start)
+			p.loops++
 			if err != nil {
-				return nil, err
+				return nil, nil, 0, err
 			}
-			nodes = append(nodes, &ifNode{cond: m[1], thenN: th, elseN: el})
-			continue
+			return body, elseBody, elseLine, nil
 		}
-		if m := reFor.FindStringSubmatch(line); m != nil {
-			p.cursor++
-			body, err := p.parseUntilEnd()
-			if err != nil {
-				return nil, err
-			}
-			
-			// 解析变量名，支持 key, value 语法
-			vars := strings.Split(m[1], ",")
-			var varName, varName2 string
-			if len(vars) == 1 {
-				varName = strings.TrimSpace(vars[0])
-			} else if len(vars) == 2 {
-				varName = strings.TrimSpace(vars[0])
-				varName2 = strings.TrimSpace(vars[1])
-			}
-			
-			nodes = append(nodes, &forNode{varName: varName, varName2: varName2, iter: m[2], body: body})
+
+		n, ok, err := p.parseDirective(line)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if ok {
+			body = append(body, n)
 			continue
 		}
-		if m := reInclude.FindStringSubmatch(line); m != nil {
+
+		parts, err := p.splitLine(line)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		body = append(body, parts...)
+		p.cursor++
+	}
+	return nil, nil, 0, fmt.Errorf("line %d: unterminated #for: missing #end", start)
+}
+
+// parseUntilEnd 解析直到遇到 #end，directive 和 start 为块起始指令及其行号，用于错误信息
+func (p *parser) parseUntilEnd(directive string, start int) ([]node, error) {
+	var nodes []node
+	for p.cursor < len(p.lines) {
+		line := p.current()
+		if p.syn.reEnd.MatchString(line) {
 			p.cursor++
-			nodes = append(nodes, &includeNode{path: m[1]})
+			return nodes, nil
+		}
+		// nested
+		n, ok, err := p.parseDirective(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			nodes = append(nodes, n)
 			continue
 		}
 
+		parts, err := p.splitLine(line)
+		if err != nil {
+			return nil, err
+		}
 		p.cursor++
-		parts := splitExprs(line)
 		nodes = append(nodes, parts...)
 	}
-	return nil, errors.New("unterminated block: missing #end")
+	return nil, fmt.Errorf("line %d: unterminated %s: missing #end", start, directive)
 }
 
-// splitExprs splits a line into text/expr nodes.
-// Supports:  #( ... )   and   ${ ... }
-var (
-	reHashExpr  = regexp.MustCompile(`#\((.*?)\)`)  // non-greedy
-	reDollarExp = regexp.MustCompile(`\$\{(.*?)\}`) // non-greedy
-)
+// reForModifier 匹配 #for 子句末尾的 sorted / reversed 修饰词
+var reForModifier = regexp.MustCompile(`\s+(sorted|reversed)\s*$`)
 
-// splitExprs 将包含表达式的行分割成文本节点和表达式节点
-func splitExprs(line string) []node {
-	// First process #( ... )
-	nodes := splitByRegex(line, reHashExpr, func(code string) node { return &exprNode{code: code} })
-	// For each text node, further split by ${ ... }
-	var out []node
-	for _, n := range nodes {
-		if t, ok := n.(*textNode); ok {
-			out = append(out, splitByRegex(t.text, reDollarExp, func(code string) node { return &exprNode{code: code} })...)
-		} else {
-			out = append(out, n)
+// parseForClause 解析 #for 中 in 之后的部分
+// 支持 `expr [if cond] [sorted] [reversed]`，例如 `ports if p > 1024 sorted`
+func parseForClause(clause string) (iter, filter string, sorted, reversed bool) {
+	clause = strings.TrimSpace(clause)
+	for {
+		loc := reForModifier.FindStringSubmatchIndex(clause)
+		if loc == nil || loc[0] == 0 {
+			break
+		}
+		switch clause[loc[2]:loc[3]] {
+		case "sorted":
+			sorted = true
+		case "reversed":
+			reversed = true
+		}
+		clause = strings.TrimSpace(clause[:loc[0]])
+	}
+
+	if i := indexTopLevelKeyword(clause, "if"); i > 0 {
+		return strings.TrimSpace(clause[:i]), strings.TrimSpace(clause[i+len("if"):]), sorted, reversed
+	}
+	return clause, "", sorted, reversed
+}
+
+// indexTopLevelKeyword 返回关键字在表达式顶层（字符串字面量和括号之外）第一次作为独立单词出现的位置
+// 找不到时返回 -1
+func indexTopLevelKeyword(s, kw string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case depth == 0 && strings.HasPrefix(s[i:], kw):
+			before := i == 0 || s[i-1] == ' ' || s[i-1] == '\t'
+			end := i + len(kw)
+			after := end < len(s) && (s[end] == ' ' || s[end] == '\t')
+			if before && after {
+				return i
+			}
 		}
 	}
-	// 为每行添加换行符
-	out = append(out, &textNode{text: "\n"})
-	return out
+	return -1
 }
 
-// nodeFactory 节点工厂函数类型
-type nodeFactory func(code string) node
+// splitTopLevel 按分隔符切分表达式列表，忽略字符串字面量和括号内部的分隔符
+// 空白项会被丢弃，例如 `a, f(b, c), "x,y"` 切分为三项
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == sep && depth == 0:
+			if part := strings.TrimSpace(s[start:i]); part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
 
-// splitByRegex 根据正则表达式分割字符串并创建节点
-func splitByRegex(s string, re *regexp.Regexp, makeNode nodeFactory) []node {
-	locs := re.FindAllStringSubmatchIndex(s, -1)
-	if len(locs) == 0 {
-		return []node{&textNode{text: s}}
+// splitExprs 扫描一行文本，将其分割成文本节点和表达式节点，eol 为该行的换行符，lineNo 为该行的起始行号
+// 支持 #( ... ) 和 ${ ... }，表达式中嵌套的括号和字符串字面量中的分隔符不会提前结束表达式，
+// 例如 ${ {"a": 1}.a } 和 #( f(g(x)) )
+// 前面带反斜杠的 \${ 和 \#( 是转义，去掉反斜杠后按原样输出；
+// 两个反斜杠 \\${ 表示一个普通的反斜杠，后面的表达式照常计算，例如 C:\dir\\${name}
+// 没有闭合或括号不配对的表达式返回错误，例如 ${ oops( }
+func (s *syntax) splitExprs(line, eol string, lineNo int) ([]node, error) {
+	var out []node
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			out = append(out, &textNode{text: text.String(), line: lineNo})
+			lineNo += strings.Count(text.String(), "\n")
+			text.Reset()
+		}
 	}
-	var nodes []node
-	prevEnd := 0
-	for _, loc := range locs {
-		start, end := loc[0], loc[1]
-		codeStart, codeEnd := loc[2], loc[3]
-		if start > prevEnd {
-			nodes = append(nodes, &textNode{text: s[prevEnd:start]})
-		}
-		code := strings.TrimSpace(s[codeStart:codeEnd])
-		nodes = append(nodes, makeNode(code))
-		prevEnd = end
-	}
-	if prevEnd < len(s) {
-		nodes = append(nodes, &textNode{text: s[prevEnd:]})
-	}
-	return nodes
-}
\ No newline at end of file
+
+	start := 0 // 尚未写入 text 的文本起点
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c != s.open[0] && c != s.hashOpen[0] && c != '\\' {
+			continue
+		}
+		if c == '\\' {
+			if s.escapedBackslashAt(line, i) {
+				// \\${ 输出一个反斜杠，后面的表达式照常计算
+				text.WriteString(line[start : i+1])
+				start = i + 2
+				i++
+				continue
+			}
+			// 转义：丢弃反斜杠，分隔符作为文本输出
+			if n, _ := s.exprOpenAt(line, i+1); n > 0 {
+				text.WriteString(line[start:i])
+				start = i + 1
+				i += n
+			}
+			continue
+		}
+
+		n, closer := s.exprOpenAt(line, i)
+		if n == 0 {
+			continue
+		}
+		end := matchClose(line, i+n, closer)
+		if end < 0 {
+			unclosed, _, _ := strings.Cut(line[i:], "\n")
+			return nil, fmt.Errorf("line %d: unclosed or unbalanced expression %q", lineNo+strings.Count(text.String(), "\n")+strings.Count(line[start:i], "\n"), unclosed)
+		}
+		text.WriteString(line[start:i])
+		flush()
+		en := newExprNode(line[i+n : end])
+		en.line = lineNo
+		lineNo += strings.Count(line[i:end], "\n")
+		out = append(out, en)
+		start = end + len(closer)
+		i = start - 1
+	}
+	text.WriteString(line[start:])
+	flush()
+
+	// 保留该行原有的换行符
+	if eol != "" {
+		out = append(out, &textNode{text: eol, line: lineNo})
+	}
+	return out, nil
+}
+
+// newExprNode 根据分隔符内的原始代码创建表达式节点
+// 紧贴起始分隔符的 `- ` 和紧贴结束分隔符的 ` -` 是空白控制标记，例如 ${- name -}
+func newExprNode(raw string) *exprNode {
+	n := &exprNode{}
+	if len(raw) > 1 && raw[0] == '-' && (raw[1] == ' ' || raw[1] == '\t') {
+		n.trimLeft = true
+		raw = raw[1:]
+	}
+	if l := len(raw); l > 1 && raw[l-1] == '-' && (raw[l-2] == ' ' || raw[l-2] == '\t') {
+		n.trimRight = true
+		raw = raw[:l-1]
+	}
+	n.code = strings.TrimSpace(raw)
+	return n
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestRawBlocks 测试 #raw / #verbatim 块原样输出
+func TestRawBlocks(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "Prometheus规则中的Go模板",
+			template: `- alert: HighLatency
+#raw
+  annotations:
+    summary: "{{ $labels.instance }} latency ${ $value }"
+#end
+  labels:
+    team: ${team}`,
+			context:  map[string]any{"team": "sre"},
+			expected: "- alert: HighLatency\n  annotations:\n    summary: \"{{ $labels.instance }} latency ${ $value }\"\n  labels:\n    team: sre",
+		},
+		{
+			name: "verbatim中的指令和表达式不生效",
+			template: `#verbatim
+server_name ${SERVER_NAME};
+#if $host
+#(not an expression)
+#* not a comment *#
+#-- not a comment either
+#end`,
+			context:  map[string]any{},
+			expected: "server_name ${SERVER_NAME};\n#if $host\n#(not an expression)\n#* not a comment *#\n#-- not a comment either\n",
+		},
+		{
+			name: "跨行的未闭合表达式原样保留",
+			template: `#raw
+value: ${
+#end
+done`,
+			context:  map[string]any{},
+			expected: "value: ${\ndone",
+		},
+		{
+			name: "条件中的raw块",
+			template: `#if enabled
+  #raw
+  location / { proxy_pass ${UPSTREAM}; }
+  #end
+#end`,
+			context:  map[string]any{"enabled": true},
+			expected: "  location / { proxy_pass ${UPSTREAM}; }\n",
+		},
+		{
+			name: "循环中的raw块",
+			template: `#for i in range(2)
+#raw
+${i}
+#end
+#end`,
+			context:  map[string]any{},
+			expected: "${i}\n${i}\n",
+		},
+		{
+			name: "空的raw块",
+			template: `a
+#raw
+#end
+b`,
+			context:  map[string]any{},
+			expected: "a\nb",
+		},
+		{
+			name: "raw块的空白控制",
+			template: `[
+#-raw
+{{ .Items }}
+#-end
+]`,
+			context:  map[string]any{},
+			expected: "[{{ .Items }}]",
+		},
+		{
+			name: "转义的raw指令行",
+			template: `##raw
+${x}`,
+			context:  map[string]any{"x": 1},
+			expected: "#raw\n1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestRawBlockErrors 测试未闭合的 #raw 块
+func TestRawBlockErrors(t *testing.T) {
+	eng := New(os.DirFS("."))
+	_, err := eng.ParseString("a\n#raw\n${x}")
+	if err == nil {
+		t.Fatal("期望解析错误")
+	}
+	if want := "line 2: unterminated #raw: missing #end"; err.Error() != want {
+		t.Errorf("期望: %q, 实际: %q", want, err.Error())
+	}
+}
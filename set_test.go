@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestSetDirective 测试 #set / #let 变量定义
+func TestSetDirective(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name        string
+		template    string
+		context     map[string]any
+		expected    string
+		shouldError bool
+	}{
+		{
+			name: "顶层定义变量并多次使用",
+			template: `#set ns = namespace ?? "default"
+#set fullName = appName + "-" + ns
+name: ${fullName}
+service: ${fullName}-svc`,
+			context:  map[string]any{"appName": "web"},
+			expected: "name: web-default\nservice: web-default-svc",
+		},
+		{
+			name: "let是set的别名",
+			template: `#let total = price * quantity
+total: ${total}`,
+			context:  map[string]any{"price": 10, "quantity": 3},
+			expected: "total: 30",
+		},
+		{
+			name: "重新赋值",
+			template: `#set x = 1
+${x}
+#set x = x + 1
+${x}`,
+			context:  map[string]any{},
+			expected: "1\n2",
+		},
+		{
+			name: "if块内定义的变量只在块内有效",
+			template: `#set label = "outer"
+#if enabled
+#set label = "inner"
+in: ${label}
+#end
+out: ${label}`,
+			context:  map[string]any{"enabled": true},
+			expected: "in: inner\nout: outer",
+		},
+		{
+			name: "块内定义的新变量在块外不可见",
+			template: `#if true
+#set tmp = "x"
+#end
+tmp: ${tmp ?? "unset"}`,
+			context:  map[string]any{},
+			expected: "tmp: unset",
+		},
+		{
+			name: "循环中每次迭代重新计算",
+			template: `#for c in containers
+#set tag = c.tag ?? "latest"
+- ${c.name}: ${c.image + ":" + tag}
+#end`,
+			context: map[string]any{
+				"containers": []any{
+					map[string]any{"name": "web", "image": "nginx", "tag": "1.25"},
+					map[string]any{"name": "sidecar", "image": "busybox"},
+				},
+			},
+			expected: "- web: nginx:1.25\n- sidecar: busybox:latest\n",
+		},
+		{
+			name: "覆盖上下文变量不影响之后的块外内容",
+			template: `#for item in items
+#set appName = item
+${appName}
+#end
+${appName}`,
+			context: map[string]any{
+				"appName": "app",
+				"items":   []string{"a", "b"},
+			},
+			expected: "a\nb\napp",
+		},
+		{
+			name:        "表达式错误",
+			template:    `#set x = 10 / 0`,
+			context:     map[string]any{},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				if tt.shouldError {
+					return // 期望的错误
+				}
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if tt.shouldError {
+				t.Errorf("期望出现错误，但成功执行了")
+				return
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestSetDoesNotMutateContext 测试 #set 不会修改调用方传入的上下文
+func TestSetDoesNotMutateContext(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString(`#set appName = "changed"
+${appName}`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+
+	ctx := map[string]any{"appName": "original"}
+	result, err := tpl.Render(ctx)
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if result != "changed" {
+		t.Errorf("期望: %q, 实际: %q", "changed", result)
+	}
+	if ctx["appName"] != "original" {
+		t.Errorf("上下文被修改: %v", ctx["appName"])
+	}
+}
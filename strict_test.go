@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestStrictDirectiveErrors 测试位置错误、格式错误和其他模板语言写法的指令
+func TestStrictDirectiveErrors(t *testing.T) {
+	eng := New(os.DirFS("."))
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "多余的end",
+			template: "a: 1\n#end",
+			expected: "line 2: unexpected #end without an open block",
+		},
+		{
+			name:     "块结束后多余的end",
+			template: "#if true\nx\n#end\n#end",
+			expected: "line 4: unexpected #end without an open block",
+		},
+		{
+			name:     "顶层的else",
+			template: "x\n#else\ny",
+			expected: "line 2: unexpected #else without #if or #for",
+		},
+		{
+			name:     "循环else分支中的else",
+			template: "#for x in xs\n#else\n#else\n#end",
+			expected: "line 3: unexpected #else without #if or #for",
+		},
+		{
+			name:     "循环中的elif",
+			template: "#for x in xs\n#elif x\n#end",
+			expected: "line 2: unexpected #elif without #if",
+		},
+		{
+			name:     "switch之外的case",
+			template: "#if true\n#case 1\n#end",
+			expected: "line 2: unexpected #case outside of #switch",
+		},
+		{
+			name:     "switch之外的default",
+			template: "#default",
+			expected: "line 1: unexpected #default outside of #switch",
+		},
+		{
+			name:     "for格式错误",
+			template: "#for x of xs\n#end",
+			expected: `line 1: malformed #for directive, expected "#for x in expr"`,
+		},
+		{
+			name:     "include缺少引号",
+			template: "#include file.yaml",
+			expected: `line 1: malformed #include directive, expected "#include \"file\" [with expr] [only] [noindent | indent N]"`,
+		},
+		{
+			name:     "define缺少括号",
+			template: "#define helper\n#end",
+			expected: `line 1: malformed #define directive, expected "#define name(a, b)"`,
+		},
+		{
+			name:     "end后面有多余内容",
+			template: "#if true\n#end if",
+			expected: `line 2: malformed #end directive, expected "#end"`,
+		},
+		{
+			name:     "Shell风格的fi",
+			template: "#if true\nx\n#fi",
+			expected: `line 3: unknown directive "#fi", did you mean "#end"?`,
+		},
+		{
+			name:     "endif",
+			template: "#if true\nx\n#endif",
+			expected: `line 3: unknown directive "#endif", did you mean "#end"?`,
+		},
+		{
+			name:     "elseif",
+			template: "#if a\n#elseif b\n#end",
+			expected: `line 2: unknown directive "#elseif", did you mean "#elif"?`,
+		},
+		{
+			name:     "import",
+			template: "#import \"a.yaml\"",
+			expected: `line 1: unknown directive "#import", did you mean "#include"?`,
+		},
+		{
+			name:     "带空白控制标记的endif",
+			template: "#if true\n#-endif",
+			expected: `line 2: unknown directive "#endif", did you mean "#end"?`,
+		},
+		{
+			name:     "嵌套块中的错误",
+			template: "#for x in xs\n#if x\n#endfor\n#end\n#end",
+			expected: `line 3: unknown directive "#endfor", did you mean "#end"?`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := eng.ParseString(tt.template)
+			if err == nil {
+				t.Fatalf("期望解析错误: %s", tt.expected)
+			}
+			if err.Error() != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, err.Error())
+			}
+		})
+	}
+}
+
+// TestStrictDirectiveComments 测试普通注释不会被当作写错的指令
+func TestStrictDirectiveComments(t *testing.T) {
+	eng := New(os.DirFS("."))
+	template := `#!/bin/bash
+# if you change this, also update the chart
+#TODO: remove after migration
+#region settings
+#---------
+#{not a directive}
+##endif
+#Set replicas here
+#Default values
+#DONE migrating
+#done migrating
+#import stuff
+#form fields
+#fore
+#IF true
+#end-of-file`
+	tpl, err := eng.ParseString(template)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err := tpl.Render(map[string]any{})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if result != template {
+		t.Errorf("期望: %q, 实际: %q", template, result)
+	}
+}
+
+// TestStrictDirectiveCustomPrefix 测试自定义前缀下的错误提示
+func TestStrictDirectiveCustomPrefix(t *testing.T) {
+	eng := New(os.DirFS("."), WithDirectivePrefix("#@"))
+
+	_, err := eng.ParseString("#@if x\n#@endif")
+	if expected := `line 2: unknown directive "#@endif", did you mean "#@end"?`; err == nil || err.Error() != expected {
+		t.Errorf("期望: %q, 实际: %v", expected, err)
+	}
+
+	// 使用 # 前缀的行在 #@ 前缀下只是普通文本
+	if _, err := eng.ParseString("#endif\n#end"); err != nil {
+		t.Errorf("期望解析成功, 实际: %v", err)
+	}
+}
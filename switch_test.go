@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestSwitchDirective 测试 #switch / #case / #default
+func TestSwitchDirective(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	storage := `#switch cloud
+#case "aws"
+storageClassName: gp3
+#case "gcp", "gke"
+storageClassName: standard-rwo
+#default
+storageClassName: standard
+#end`
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name:     "命中第一个分支",
+			template: storage,
+			context:  map[string]any{"cloud": "aws"},
+			expected: "storageClassName: gp3\n",
+		},
+		{
+			name:     "多个候选值",
+			template: storage,
+			context:  map[string]any{"cloud": "gke"},
+			expected: "storageClassName: standard-rwo\n",
+		},
+		{
+			name:     "默认分支",
+			template: storage,
+			context:  map[string]any{"cloud": "azure"},
+			expected: "storageClassName: standard\n",
+		},
+		{
+			name: "没有命中且没有默认分支",
+			template: `before
+#switch size
+#case "small"
+cpu: 100m
+#end
+after`,
+			context:  map[string]any{"size": "large"},
+			expected: "before\nafter",
+		},
+		{
+			name: "数字按数值比较",
+			template: `#switch replicas
+#case 1
+single
+#case 2, 3
+few
+#default
+many
+#end`,
+			context:  map[string]any{"replicas": int64(3)},
+			expected: "few\n",
+		},
+		{
+			name: "候选值可以是表达式",
+			template: `#switch env
+#case defaultEnv
+default environment
+#case "prod"
+production
+#end`,
+			context:  map[string]any{"env": "staging", "defaultEnv": "staging"},
+			expected: "default environment\n",
+		},
+		{
+			name: "switch与第一个case之间的空行被忽略",
+			template: `#switch kind
+
+  #case "nginx"
+ingressClassName: nginx
+  #case "traefik"
+ingressClassName: traefik
+#end`,
+			context:  map[string]any{"kind": "traefik"},
+			expected: "ingressClassName: traefik\n",
+		},
+		{
+			name: "分支中的嵌套指令",
+			template: `#switch mode
+#case "list"
+#for p in ports
+- ${p}
+#end
+#default
+#if debug
+debug
+#end
+#end`,
+			context:  map[string]any{"mode": "list", "ports": []int{80, 443}},
+			expected: "- 80\n- 443\n",
+		},
+		{
+			name: "循环中的switch",
+			template: `#for t in types
+#switch t
+#case "a"
+A
+#case "b"
+#continue
+#default
+?
+#end
+#end`,
+			context:  map[string]any{"types": []string{"a", "b", "c"}},
+			expected: "A\n?\n",
+		},
+		{
+			name: "subject为nil",
+			template: `#switch missing
+#case nil
+none
+#default
+some
+#end`,
+			context:  map[string]any{"missing": nil},
+			expected: "none\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestSwitchEvaluatesSubjectOnce 测试 subject 只计算一次
+func TestSwitchEvaluatesSubjectOnce(t *testing.T) {
+	eng := New(os.DirFS("."))
+	calls := 0
+	tpl, err := eng.ParseString(`#switch next()
+#case 1
+one
+#case 2
+two
+#case 3
+three
+#end`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err := tpl.Render(map[string]any{"next": func() int { calls++; return 3 }})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if result != "three\n" || calls != 1 {
+		t.Errorf("期望输出 %q 且只计算一次, 实际: %q, 计算 %d 次", "three\n", result, calls)
+	}
+}
+
+// TestSwitchErrors 测试 #switch 的解析错误
+func TestSwitchErrors(t *testing.T) {
+	eng := New(os.DirFS("."))
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "未闭合",
+			template: "#switch x\n#case 1\none",
+			expected: "line 1: unterminated #switch: missing #end",
+		},
+		{
+			name:     "第一个case之前有内容",
+			template: "#switch x\ntext\n#case 1\n#end",
+			expected: "line 2: #switch: expected #case or #default",
+		},
+		{
+			name:     "default之后的case",
+			template: "#switch x\n#default\n#case 1\n#end",
+			expected: "line 3: #case after #default",
+		},
+		{
+			name:     "重复的default",
+			template: "#switch x\n#default\n#default\n#end",
+			expected: "line 3: duplicate #default in #switch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := eng.ParseString(tt.template)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("期望错误 %q, 实际: %v", tt.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// syntax 模板语法：指令前缀、表达式分隔符以及据此编译的正则表达式
+// 每个 Engine 持有一份，由该 Engine 解析的所有模板（包括 #include 和 #extends 的文件）共享
+type syntax struct {
+	prefix string // 指令前缀，默认 #
+	open   string // 表达式起始分隔符，默认 ${
+	close  string // 表达式结束分隔符，默认 }
+
+	// 以下字段由 compile 根据前缀和分隔符生成
+	hashOpen     string // 前缀形式表达式的起始分隔符，例如 #(，结束分隔符固定为 )
+	commentStart string // 注释块起始标记，例如 #*
+	commentEnd   string // 注释块结束标记，例如 *#
+
+	reIf      *regexp.Regexp
+	reElif    *regexp.Regexp
+	reElse    *regexp.Regexp
+	reEnd     *regexp.Regexp
+	reFor     *regexp.Regexp
+	reInclude *regexp.Regexp
+	reDefine  *regexp.Regexp
+	reSet     *regexp.Regexp
+	reLoopCtl *regexp.Regexp
+	reCall    *regexp.Regexp
+	reRaw     *regexp.Regexp
+	reExtends *regexp.Regexp
+	reBlock   *regexp.Regexp
+	reSwitch  *regexp.Regexp
+	reCase    *regexp.Regexp
+	reDefault *regexp.Regexp
+
+	// #raw 块的起止行，允许带空白控制标记，用于在合并逻辑行和解析时定位块的边界
+	reRawStart *regexp.Regexp
+	reRawEnd   *regexp.Regexp
+
+	reDirectiveStart   *regexp.Regexp // 以指令关键字开头的行，用于识别可以用反斜杠续行的指令和跨行表达式的结束位置
+	reLineComment      *regexp.Regexp // #-- 开头的模板注释行
+	reTrimLeftMarker   *regexp.Regexp // 指令名前的 #- 空白控制标记
+	reEscapedDirective *regexp.Regexp // 以 ## 开头的转义指令行，例如 `##if you change this...`
+
+	directivePatterns []*regexp.Regexp // 所有指令行的模式，用于判断去掉空白控制标记后的行是否为指令
+
+	keywordPatterns map[string]*regexp.Regexp // 只有关键字的指令行，例如 #end、#else，用于检查位置错误的指令
+	reDirectiveWord *regexp.Regexp            // 指令前缀后紧跟的单词（不含 #end-of-file 这样的连字符单词），用于检查写错的指令
+}
+
+// directiveKeywords 所有指令关键字
+var directiveKeywords = []string{"if", "elif", "else", "end", "for", "include", "define", "set", "let", "break", "continue", "call", "raw", "verbatim", "extends", "block", "switch", "case", "default"}
+
+// defaultSyntax 默认语法：# 指令前缀，${ } 表达式分隔符
+var defaultSyntax = newSyntax("#", "${", "}")
+
+// newSyntax 根据指令前缀和表达式分隔符创建语法
+func newSyntax(prefix, open, close string) *syntax {
+	s := &syntax{prefix: prefix, open: open, close: close}
+	s.compile()
+	return s
+}
+
+// compile 根据前缀和分隔符编译所有正则表达式
+// 模式中的 # 代表指令前缀；前缀或分隔符为空时 panic，与 regexp.MustCompile 一样属于编程错误
+func (s *syntax) compile() {
+	if s.prefix == "" {
+		panic("htpl: directive prefix must not be empty")
+	}
+	if s.open == "" || s.close == "" {
+		panic(fmt.Sprintf("htpl: invalid expression delimiters %q %q", s.open, s.close))
+	}
+
+	quoted := regexp.QuoteMeta(s.prefix)
+	re := func(pattern string) *regexp.Regexp {
+		return regexp.MustCompile(strings.ReplaceAll(pattern, "#", quoted))
+	}
+
+	s.hashOpen = s.prefix + "("
+	s.commentStart = s.prefix + "*"
+	s.commentEnd = "*" + s.prefix
+
+	s.reIf = re(`^\s*#if\s+(.+)$`)
+	s.reElif = re(`^\s*#(?:elif|else\s+if)\s+(.+)$`)
+	s.reElse = re(`^\s*#else\s*$`)
+	s.reEnd = re(`^\s*#end\s*$`)
+	s.reFor = re(`^\s*#for\s+([a-zA-Z_][a-zA-Z0-9_]*(?:\s*,\s*[a-zA-Z_][a-zA-Z0-9_]*)?)\s+in\s+(.+)$`)
+	s.reInclude = re(`^(\s*)#include\s+"([^"]+)"(?:\s+with\s+(.+?))?(\s+only)?(?:\s+(?:(noindent)|indent\s+(\d+)))?\s*$`)
+	s.reDefine = re(`^\s*#define\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*\(\s*([a-zA-Z_][a-zA-Z0-9_]*(?:\s*,\s*[a-zA-Z_][a-zA-Z0-9_]*)*)?\s*\)\s*$`)
+	s.reSet = re(`^\s*#(?:set|let)\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*([^=\s].*)$`)
+	s.reLoopCtl = re(`^\s*#(break|continue)(?:\s+if\s+(.+?))?\s*$`)
+	s.reCall = re(`^\s*#call\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*\((.*)\)\s*$`)
+	s.reRaw = re(`^\s*#(?:raw|verbatim)\s*$`)
+	s.reExtends = re(`^\s*#extends\s+"([^"]+)"\s*$`)
+	s.reBlock = re(`^\s*#block\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*$`)
+	s.reSwitch = re(`^\s*#switch\s+(.+)$`)
+	s.reCase = re(`^\s*#case\s+(.+)$`)
+	s.reDefault = re(`^\s*#default\s*$`)
+
+	s.reRawStart = re(`^\s*#-?(?:raw|verbatim)(?:\s+-)?\s*$`)
+	s.reRawEnd = re(`^\s*#-?end(?:\s+-)?\s*$`)
+
+	s.reDirectiveStart = re(`^\s*#-?(?:` + strings.Join(directiveKeywords, "|") + `)(?:\s|\\|$)`)
+	s.reLineComment = re(`^\s*#--(?:\s|$)`)
+	s.reTrimLeftMarker = re(`^(\s*)#-([a-zA-Z])`)
+	s.reEscapedDirective = re(`^(\s*)#(#-?(?:` + strings.Join(directiveKeywords, "|") + `)(?:\s|$))`)
+
+	s.directivePatterns = []*regexp.Regexp{
+		s.reIf, s.reElif, s.reElse, s.reEnd, s.reFor, s.reInclude, s.reDefine, s.reSet, s.reLoopCtl,
+		s.reCall, s.reRaw, s.reExtends, s.reBlock, s.reSwitch, s.reCase, s.reDefault,
+	}
+
+	s.keywordPatterns = map[string]*regexp.Regexp{
+		"end":     s.reEnd,
+		"else":    s.reElse,
+		"elif":    s.reElif,
+		"case":    s.reCase,
+		"default": s.reDefault,
+	}
+	s.reDirectiveWord = re(`^\s*#-?([a-zA-Z]+)(?:[^a-zA-Z0-9_-]|$)`)
+}
+
+// isDirectiveLine 判断一行是否为指令行
+func (s *syntax) isDirectiveLine(line string) bool {
+	for _, re := range s.directivePatterns {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayBeDirective 快速判断一行是否可能是指令行（第一个非空白字符开始是指令前缀），
+// 绝大多数普通文本行可以据此跳过所有指令正则的匹配
+func (s *syntax) mayBeDirective(line string) bool {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ', '\t':
+			continue
+		default:
+			return strings.HasPrefix(line[i:], s.prefix)
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestCustomSyntax 测试自定义指令前缀和表达式分隔符
+func TestCustomSyntax(t *testing.T) {
+	loader := os.DirFS(".")
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "自定义指令前缀",
+			opts: []Option{WithDirectivePrefix("#@")},
+			template: `# Python 注释：#if 不再是指令
+#@if debug
+DEBUG = True
+#@end
+#@for m in modules
+import ${m}
+#@end`,
+			context:  map[string]any{"debug": true, "modules": []string{"os", "sys"}},
+			expected: "# Python 注释：#if 不再是指令\nDEBUG = True\nimport os\nimport sys\n",
+		},
+		{
+			name: "默认前缀的指令在自定义前缀下按文本输出",
+			opts: []Option{WithDirectivePrefix("#@")},
+			template: `#if x
+#for y in z
+#end`,
+			context:  map[string]any{},
+			expected: "#if x\n#for y in z\n#end",
+		},
+		{
+			name:     "自定义前缀的表达式和注释",
+			opts:     []Option{WithDirectivePrefix("#@")},
+			template: "#@-- 模板注释\nvalue: #@(1 + 2) #(not expr) #@* 注释 *#@",
+			context:  map[string]any{},
+			expected: "value: 3 #(not expr) ",
+		},
+		{
+			name: "自定义表达式分隔符",
+			opts: []Option{WithDelimiters("{{", "}}")},
+			template: `export PATH="${HOME}/bin"
+echo "{{ message }}"
+echo {{ {"a": 1}.a }}`,
+			context:  map[string]any{"message": "hi"},
+			expected: "export PATH=\"${HOME}/bin\"\necho \"hi\"\necho 1",
+		},
+		{
+			name:     "自定义分隔符的转义和空白控制",
+			opts:     []Option{WithDelimiters("{{", "}}")},
+			template: "a: \\{{ raw }}\nb:   {{- name -}}   !",
+			context:  map[string]any{"name": "x"},
+			expected: "a: {{ raw }}\nb:x!",
+		},
+		{
+			name: "同时自定义前缀和分隔符",
+			opts: []Option{WithDirectivePrefix("%"), WithDelimiters("<%=", "%>")},
+			template: `% shell comment stays
+%for i in range(2)
+echo ${VAR} <%= i %>
+%end`,
+			context:  map[string]any{},
+			expected: "% shell comment stays\necho ${VAR} 0\necho ${VAR} 1\n",
+		},
+		{
+			name: "自定义前缀的转义、续行和空白控制",
+			opts: []Option{WithDirectivePrefix("@@")},
+			template: `@@@@if literal
+[
+@@-for x in \
+    xs
+${x},
+@@-end
+]`,
+			context:  map[string]any{"xs": []int{1, 2}},
+			expected: "@@if literal\n[1,2,]",
+		},
+		{
+			name: "自定义分隔符的跨行表达式",
+			opts: []Option{WithDelimiters("{{", "}}")},
+			template: `args: {{ join(
+  items, ",") }}`,
+			context:  map[string]any{"items": []string{"a", "b"}},
+			expected: "args: a,b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := New(loader, tt.opts...)
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestCustomSyntaxInclude 测试被包含的文件使用同一个引擎的语法
+func TestCustomSyntaxInclude(t *testing.T) {
+	err := os.WriteFile("test_syntax_partial.tpl", []byte(`#@if enabled
+name: {{ name }}
+#@end`), 0644)
+	if err != nil {
+		t.Fatalf("创建测试文件失败: %v", err)
+	}
+	defer os.Remove("test_syntax_partial.tpl")
+
+	eng := New(os.DirFS("."), WithDirectivePrefix("#@"), WithDelimiters("{{", "}}"))
+	tpl, err := eng.ParseString(`#@include "test_syntax_partial.tpl"`)
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	result, err := tpl.Render(map[string]any{"enabled": true, "name": "web"})
+	if err != nil {
+		t.Fatalf("渲染模板失败: %v", err)
+	}
+	if expected := "name: web\n"; result != expected {
+		t.Errorf("期望: %q, 实际: %q", expected, result)
+	}
+}
+
+// TestInvalidSyntaxOptions 测试无效的语法配置
+func TestInvalidSyntaxOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "空的指令前缀", opts: []Option{WithDirectivePrefix("")}},
+		{name: "空的分隔符", opts: []Option{WithDelimiters("", "}}")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("期望 panic")
+				}
+			}()
+			New(os.DirFS("."), tt.opts...)
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/expr-lang/expr/ast"
+	exprparser "github.com/expr-lang/expr/parser"
+)
+
+// Variable 模板引用的一个上下文变量
+type Variable struct {
+	Name string // 顶层变量名，例如 ingress
+	Path string // 引用的完整路径，例如 ingress.host；直接引用变量本身时与 Name 相同
+	Line int    // 第一次引用所在的行号
+	File string // 第一次引用所在的模板文件（#include 或 #extends 的路径），在当前模板中为空
+
+	HasDefault bool   // 每一处引用都通过 ?? 提供了默认值，渲染时可以不传入
+	Default    string // 第一个默认值表达式的源码，没有默认值时为空
+	LoopBound  bool   // 只作为 #for 的循环变量使用，不需要从上下文传入
+}
+
+// Variables 静态分析模板引用的上下文变量，按路径排序返回
+// 分析覆盖模板中的所有表达式，并通过 Engine.Loader 跟随 #include 的模板和 #extends 的父模板；
+// #set 定义的变量、宏参数和内置函数不计入结果，#include ... only 的模板只能看到 with 传入的参数，也不计入
+func (t *Template) Variables() ([]Variable, error) {
+	a := &varAnalyzer{eng: t.engine, vars: map[string]*Variable{}}
+	if err := a.template(t, "", varScope{}); err != nil {
+		return nil, err
+	}
+
+	out := make([]Variable, 0, len(a.vars))
+	for _, v := range a.vars {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+// varBinding 作用域中模板自身绑定的名称的来源
+type varBinding int
+
+const (
+	bindLocal varBinding = iota // #set 定义的变量、宏参数、宏名等，不来自上下文
+	bindLoop                    // #for 的循环变量
+)
+
+// varScope 分析时当前位置模板自身绑定的名称
+type varScope map[string]varBinding
+
+// with 返回添加了给定名称的作用域副本
+func (s varScope) with(binding varBinding, names ...string) varScope {
+	out := make(varScope, len(s)+len(names))
+	for k, v := range s {
+		out[k] = v
+	}
+	for _, name := range names {
+		out[name] = binding
+	}
+	return out
+}
+
+// blockRef 子模板对 #block 的覆盖及其所在文件
+type blockRef struct {
+	block *blockNode
+	file  string
+}
+
+// varAnalyzer 收集模板引用的变量
+type varAnalyzer struct {
+	eng    *Engine
+	vars   map[string]*Variable
+	files  []string              // 正在分析的 #include / #extends 模板，用于避免循环
+	blocks map[string][]blockRef // 子模板对 #block 的覆盖，越靠近子模板越靠前
+	super  bool                  // 当前 #block 中是否调用了 super()
+}
+
+// template 分析一个模板，file 为模板路径，当前模板为空
+func (a *varAnalyzer) template(t *Template, file string, sc varScope) error {
+	for name := range t.macros {
+		sc[name] = bindLocal
+	}
+	if t.extends == "" {
+		return a.nodes(t.nodes, file, sc)
+	}
+
+	// 与渲染时一致：子模板顶层只有 #set 生效，其余内容通过覆盖父模板的 #block 输出
+	for _, n := range t.nodes {
+		if s, ok := n.(*setNode); ok {
+			if err := a.node(s, file, sc); err != nil {
+				return err
+			}
+		}
+	}
+	path := resolvePath(t.path, t.extends)
+	if a.visiting(path) {
+		return nil
+	}
+	parent, err := t.engine.include(path)
+	if err != nil {
+		return fmt.Errorf("line %d: #extends %q: %w", t.extendsLine, t.extends, err)
+	}
+
+	blocks := a.blocks
+	a.blocks = make(map[string][]blockRef, len(blocks)+len(t.blocks))
+	for name, refs := range blocks {
+		a.blocks[name] = refs
+	}
+	for name, b := range t.blocks {
+		a.blocks[name] = append(append([]blockRef(nil), blocks[name]...), blockRef{b, file})
+	}
+	a.files = append(a.files, path)
+	err = a.template(parent, path, sc)
+	a.files = a.files[:len(a.files)-1]
+	a.blocks = blocks
+	if err != nil {
+		return fmt.Errorf("line %d: #extends %q: %w", t.extendsLine, t.extends, err)
+	}
+	return nil
+}
+
+// visiting 判断模板是否已经在分析链中
+func (a *varAnalyzer) visiting(path string) bool {
+	for _, f := range a.files {
+		if f == path {
+			return true
+		}
+	}
+	return false
+}
+
+// nodes 依次分析节点，#set 定义的变量在之后的节点中可见
+func (a *varAnalyzer) nodes(nodes []node, file string, sc varScope) error {
+	for _, n := range nodes {
+		if err := a.node(n, file, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// node 分析一个节点
+func (a *varAnalyzer) node(n node, file string, sc varScope) error {
+	switch n := n.(type) {
+	case *exprNode:
+		return a.expr(n.code, n.line, file, sc)
+	case *setNode:
+		if err := a.expr(n.value.code, n.line, file, sc); err != nil {
+			return err
+		}
+		sc[n.name] = bindLocal
+	case *ifNode:
+		if err := a.expr(n.cond.code, n.line, file, sc); err != nil {
+			return err
+		}
+		if err := a.nodes(n.thenN, file, sc.with(bindLocal)); err != nil {
+			return err
+		}
+		for _, b := range n.elifs {
+			if err := a.expr(b.cond.code, b.line, file, sc); err != nil {
+				return err
+			}
+			if err := a.nodes(b.body, file, sc.with(bindLocal)); err != nil {
+				return err
+			}
+		}
+		return a.nodes(n.elseN, file, sc.with(bindLocal))
+	case *switchNode:
+		if err := a.expr(n.subject.code, n.line, file, sc); err != nil {
+			return err
+		}
+		for _, c := range n.cases {
+			for _, v := range c.values {
+				if err := a.expr(v.code, c.line, file, sc); err != nil {
+					return err
+				}
+			}
+			if err := a.nodes(c.body, file, sc.with(bindLocal)); err != nil {
+				return err
+			}
+		}
+		return a.nodes(n.defaultN, file, sc.with(bindLocal))
+	case *forNode:
+		if err := a.expr(n.iter.code, n.line, file, sc); err != nil {
+			return err
+		}
+		inner := sc.with(bindLoop, n.varName)
+		if n.varName2 != "" {
+			inner[n.varName2] = bindLoop
+		}
+		inner["loop"] = bindLocal
+		if n.filter != nil {
+			if err := a.expr(n.filter.code, n.line, file, inner); err != nil {
+				return err
+			}
+		}
+		if err := a.nodes(n.body, file, inner); err != nil {
+			return err
+		}
+		return a.nodes(n.elseN, file, sc.with(bindLocal))
+	case *loopCtlNode:
+		if n.cond != nil {
+			return a.expr(n.cond.code, n.line, file, sc)
+		}
+	case *callNode:
+		for _, arg := range n.args {
+			if err := a.expr(arg.code, n.line, file, sc); err != nil {
+				return err
+			}
+		}
+	case *blockNode:
+		return a.block(n, file, sc)
+	case *includeNode:
+		return a.include(n, file, sc)
+	}
+	// 文本节点没有变量；宏体只能看到参数和其他宏，其中的变量不来自上下文
+	return nil
+}
+
+// block 分析 #block，有覆盖时分析最靠近子模板的覆盖，其中调用了 super() 时继续分析下一层
+func (a *varAnalyzer) block(n *blockNode, file string, sc varScope) error {
+	chain := append(append([]blockRef(nil), a.blocks[n.name]...), blockRef{n, file})
+	outer := a.super
+	defer func() { a.super = outer }()
+	for _, ref := range chain {
+		a.super = false
+		if err := a.nodes(ref.block.body, ref.file, sc.with(bindLocal, "super")); err != nil {
+			return fmt.Errorf("line %d: #block %s: %w", ref.block.line, ref.block.name, err)
+		}
+		if !a.super {
+			break
+		}
+	}
+	return nil
+}
+
+// include 分析 #include 的 with 参数和被包含的模板
+// 被包含的模板继承调用方的变量，with 中以字面量给出的参数在其中不计入结果
+func (a *varAnalyzer) include(n *includeNode, file string, sc varScope) error {
+	inner := sc.with(bindLocal)
+	if n.with != nil {
+		if err := a.expr(n.with.code, n.line, file, sc); err != nil {
+			return err
+		}
+		if tree, err := exprparser.Parse(n.with.code); err == nil {
+			if m, ok := tree.Node.(*ast.MapNode); ok {
+				for _, pair := range m.Pairs {
+					if key, ok := pair.(*ast.PairNode).Key.(*ast.StringNode); ok {
+						inner[key.Value] = bindLocal
+					}
+				}
+			}
+		}
+	}
+	if n.only {
+		return nil
+	}
+
+	path := n.file
+	if a.visiting(path) {
+		return nil
+	}
+	t, err := a.eng.include(path)
+	if err != nil {
+		return fmt.Errorf("line %d: #include %q: %w", n.line, n.path, err)
+	}
+	a.files = append(a.files, path)
+	err = a.template(t, path, inner)
+	a.files = a.files[:len(a.files)-1]
+	if err != nil {
+		return fmt.Errorf("line %d: #include %q: %w", n.line, n.path, err)
+	}
+	return nil
+}
+
+// expr 分析一个表达式中引用的变量
+func (a *varAnalyzer) expr(code string, line int, file string, sc varScope) error {
+	tree, err := exprparser.Parse(code)
+	if err != nil {
+		if tree, err = exprparser.Parse(preprocessNullCoalescing(code)); err != nil {
+			return lineError(line, err)
+		}
+	}
+
+	refs := &refCollector{
+		inner:    map[ast.Node]bool{},
+		defaults: map[ast.Node]string{},
+		declared: map[string]bool{},
+	}
+	ast.Walk(&tree.Node, refs)
+
+	for _, ref := range refs.refs {
+		if refs.inner[ref] {
+			continue
+		}
+		path, ok := refPath(ref)
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(path, ".")
+		if name == "super" {
+			a.super = true
+		}
+		binding, bound := sc[name]
+		if bound && binding == bindLocal || refs.declared[name] || strings.HasPrefix(name, "__") {
+			continue
+		}
+		if _, ok := builtins[name]; ok && !bound {
+			continue
+		}
+		dflt, hasDflt := refs.defaults[ref]
+		a.record(Variable{Name: name, Path: path, Line: line, File: file, HasDefault: hasDflt, Default: dflt, LoopBound: bound})
+	}
+	return nil
+}
+
+// record 记录一处变量引用，同一路径的多处引用合并为一个结果
+func (a *varAnalyzer) record(ref Variable) {
+	v, ok := a.vars[ref.Path]
+	if !ok {
+		a.vars[ref.Path] = &ref
+		return
+	}
+	v.HasDefault = v.HasDefault && ref.HasDefault
+	if v.Default == "" {
+		v.Default = ref.Default
+	}
+	v.LoopBound = v.LoopBound && ref.LoopBound
+}
+
+// refCollector 收集表达式中的变量引用
+type refCollector struct {
+	refs     []ast.Node          // 按遍历顺序排列的标识符和成员访问
+	inner    map[ast.Node]bool   // 属于更长路径的一部分的引用
+	defaults map[ast.Node]string // 作为 ?? 左侧的引用及其默认值
+	declared map[string]bool     // 表达式中 let 声明的变量
+}
+
+// Visit 实现 ast.Visitor
+func (r *refCollector) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		r.refs = append(r.refs, n)
+	case *ast.MemberNode:
+		r.refs = append(r.refs, n)
+		if _, ok := refPath(n); ok {
+			r.inner[n.Node] = true
+		}
+	case *ast.BinaryNode:
+		if n.Operator == "??" {
+			r.markDefault(n.Left, n.Right.String())
+		}
+	case *ast.VariableDeclaratorNode:
+		r.declared[n.Name] = true
+	}
+}
+
+// markDefault 记录 ?? 左侧的引用，左侧本身是 ?? 表达式时其右侧也有默认值
+func (r *refCollector) markDefault(left ast.Node, dflt string) {
+	switch n := left.(type) {
+	case *ast.ChainNode:
+		// a?.b 的成员访问包在 ChainNode 中
+		r.markDefault(n.Node, dflt)
+	case *ast.BinaryNode:
+		if n.Operator == "??" {
+			r.markDefault(n.Right, dflt)
+		}
+	default:
+		r.defaults[left] = dflt
+	}
+}
+
+// refPath 返回由标识符和常量成员名组成的引用路径，例如 ingress.host 或 labels["app"]
+func refPath(node ast.Node) (string, bool) {
+	switch n := node.(type) {
+	case *ast.IdentifierNode:
+		return n.Value, true
+	case *ast.MemberNode:
+		prop, ok := n.Property.(*ast.StringNode)
+		if !ok {
+			return "", false
+		}
+		base, ok := refPath(n.Node)
+		if !ok {
+			return "", false
+		}
+		return base + "." + prop.Value, true
+	}
+	return "", false
+}
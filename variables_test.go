@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupVariablesTestFiles 创建变量分析测试用的被包含模板和父模板
+func setupVariablesTestFiles(t *testing.T) {
+	files := map[string]string{
+		"test_vars_labels.tpl": `app: ${appName}
+team: ${team ?? "platform"}
+#if extra
+${extra.key}: ${extra.value}
+#end`,
+		"test_vars_base.tpl": `name: ${appName}
+#block spec
+replicas: ${replicas}
+#end
+#block footer
+by: ${owner}
+#end`,
+		"test_vars_loop_a.tpl": `#include "test_vars_loop_b.tpl"
+a: ${a}`,
+		"test_vars_loop_b.tpl": `#include "test_vars_loop_a.tpl"
+b: ${b}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("创建测试文件失败: %v", err)
+		}
+		t.Cleanup(func() { os.Remove(name) })
+	}
+}
+
+// describeVariable 将变量描述为 "路径 ?? 默认值 [loop] <文件>" 形式，便于比较分析结果
+func describeVariable(v Variable) string {
+	s := v.Path
+	if v.HasDefault {
+		s += " ?? " + v.Default
+	}
+	if v.LoopBound {
+		s += " [loop]"
+	}
+	if v.File != "" {
+		s += " <" + v.File + ">"
+	}
+	return s
+}
+
+// TestTemplateVariables 测试静态分析模板引用的变量
+func TestTemplateVariables(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+	setupVariablesTestFiles(t)
+
+	tests := []struct {
+		name     string
+		template string
+		expected []string
+	}{
+		{
+			name:     "顶层变量和嵌套路径",
+			template: "host: ${ingress.host}\nport: ${ingress.ports[0]}\nlabel: ${labels[\"app\"]}\n${replicas * 2}",
+			expected: []string{"ingress.host", "ingress.ports", "labels.app", "replicas"},
+		},
+		{
+			name: "默认值",
+			template: `ns: ${namespace ?? "default"}
+tag: ${image?.tag ?? version ?? "latest"}
+env: ${env ?? "dev"} ${env}`,
+			expected: []string{`env`, `image.tag ?? version`, `namespace ?? "default"`, `version ?? "latest"`},
+		},
+		{
+			name: "循环变量",
+			template: `#for i, c in containers if c.enabled
+- ${c.name}:${loop.index} ${i}
+#else
+${c}
+#end`,
+			expected: []string{"c", "c.enabled [loop]", "c.name [loop]", "containers", "i [loop]"},
+		},
+		{
+			name: "set定义的变量和内置函数",
+			template: `#set fullName = appName + "-" + (suffix ?? "x")
+${fullName} ${strings.ToUpper(fullName)} ${len(items)} ${quote(fullName)}
+#if enabled
+#set fullName = "inner"
+#end`,
+			expected: []string{"appName", "enabled", "items", "quote", `suffix ?? "x"`},
+		},
+		{
+			name: "宏参数不计入",
+			template: `#define row(key, value)
+${key}: ${value} ${ignored}
+#end
+#call row("name", appName)
+${ row("ns", namespace) }`,
+			expected: []string{"appName", "namespace"},
+		},
+		{
+			name: "条件和多路选择",
+			template: `#if a > 1
+#elif b
+#end
+#switch cloud
+#case regions.primary, "gcp"
+#end
+#for x in xs
+#break if limit <= loop.index
+#end`,
+			expected: []string{"a", "b", "cloud", "limit", "regions.primary", "xs"},
+		},
+		{
+			name: "跟随include",
+			template: `#include "test_vars_labels.tpl" with {"team": owner, "extra": nil}
+#for extra in extras
+#include "test_vars_labels.tpl"
+#end
+#include "test_vars_labels.tpl" with {"appName": "x"} only`,
+			expected: []string{
+				"appName <test_vars_labels.tpl>",
+				"extra [loop] <test_vars_labels.tpl>",
+				"extra.key [loop] <test_vars_labels.tpl>",
+				"extra.value [loop] <test_vars_labels.tpl>",
+				"extras",
+				"owner",
+				`team ?? "platform" <test_vars_labels.tpl>`,
+			},
+		},
+		{
+			name:     "循环include只分析一次",
+			template: `#include "test_vars_loop_a.tpl"`,
+			expected: []string{"a <test_vars_loop_a.tpl>", "b <test_vars_loop_b.tpl>"},
+		},
+		{
+			name: "跟随extends",
+			template: `#extends "test_vars_base.tpl"
+#set owner = "me"
+${ignoredOutsideBlocks}
+#block spec
+replicas: ${ super() } ${minReplicas}
+#end
+#block footer
+by: ${maintainer}
+#end`,
+			expected: []string{"appName <test_vars_base.tpl>", "maintainer", "minReplicas", "replicas <test_vars_base.tpl>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			vars, err := tpl.Variables()
+			if err != nil {
+				t.Fatalf("分析变量失败: %v", err)
+			}
+			var got []string
+			for _, v := range vars {
+				got = append(got, describeVariable(v))
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestTemplateVariablesPosition 测试变量第一次引用的位置
+func TestTemplateVariablesPosition(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tpl, err := eng.ParseString("a: 1\nname: ${appName}\n#if appName != \"\"\n${ingress.host}\n#end")
+	if err != nil {
+		t.Fatalf("解析模板失败: %v", err)
+	}
+	vars, err := tpl.Variables()
+	if err != nil {
+		t.Fatalf("分析变量失败: %v", err)
+	}
+	expected := []Variable{
+		{Name: "appName", Path: "appName", Line: 2},
+		{Name: "ingress", Path: "ingress.host", Line: 4},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("期望: %+v, 实际: %+v", expected, vars)
+	}
+}
+
+// TestTemplateVariablesErrors 测试变量分析的错误
+func TestTemplateVariablesErrors(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		errMsg   string
+	}{
+		{
+			name:     "被包含的模板不存在",
+			template: "x\n#include \"test_vars_missing.tpl\"",
+			errMsg:   `line 2: #include "test_vars_missing.tpl"`,
+		},
+		{
+			name:     "表达式语法错误",
+			template: "a\nb: ${ x + }",
+			errMsg:   "line 2:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+			_, err = tpl.Variables()
+			if err == nil {
+				t.Fatalf("期望出现错误，但成功执行了")
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("期望错误包含 %q, 实际: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
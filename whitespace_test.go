@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestWhitespaceControl 测试指令和表达式的空白控制标记
+func TestWhitespaceControl(t *testing.T) {
+	loader := os.DirFS(".")
+	eng := New(loader)
+
+	tests := []struct {
+		name     string
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{
+			name: "表达式两侧裁剪生成单行列表",
+			template: `ports: [
+#for p in ports
+  ${- p -}
+  ${- loop.last ? "" : ", " -}
+#end
+]`,
+			context:  map[string]any{"ports": []int{80, 443}},
+			expected: "ports: [80, 443]",
+		},
+		{
+			name: "指令前的#-裁剪前一行的换行",
+			template: `items: [
+#-for x in xs
+"${x}",
+#-end
+]`,
+			context:  map[string]any{"xs": []string{"a", "b"}},
+			expected: "items: [\"a\",\"b\",]",
+		},
+		{
+			name: "指令行末尾的-裁剪之后的空白",
+			template: `#if true -
+    value
+#end`,
+			context:  map[string]any{},
+			expected: "value\n",
+		},
+		{
+			name: "左侧裁剪表达式",
+			template: `name:
+    ${- appName}`,
+			context:  map[string]any{"appName": "web"},
+			expected: "name:web",
+		},
+		{
+			name: "右侧裁剪表达式",
+			template: `${appName -}
+   -suffix`,
+			context:  map[string]any{"appName": "web"},
+			expected: "web-suffix",
+		},
+		{
+			name:     "井号表达式的裁剪标记",
+			template: "a   #(- 1 + 1 -)   b",
+			context:  map[string]any{},
+			expected: "a2b",
+		},
+		{
+			name:     "负数表达式不是裁剪标记",
+			template: "${-x} ${ -1 }",
+			context:  map[string]any{"x": 5},
+			expected: "-5 -1",
+		},
+		{
+			name: "else和end上的裁剪标记",
+			template: `[
+#-if enabled
+on
+#-else
+off
+#-end
+]`,
+			context:  map[string]any{"enabled": false},
+			expected: "[off]",
+		},
+		{
+			name: "不是指令的行末尾-保持原样",
+			template: `list: -
+- item`,
+			context:  map[string]any{},
+			expected: "list: -\n- item",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := eng.ParseString(tt.template)
+			if err != nil {
+				t.Fatalf("解析模板失败: %v", err)
+			}
+
+			result, err := tpl.Render(tt.context)
+			if err != nil {
+				t.Fatalf("渲染模板失败: %v", err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("期望: %q, 实际: %q", tt.expected, result)
+			}
+		})
+	}
+}
@@ -31,8 +31,7 @@ metadata:
 kind: Deployment  # 资源类型注释
 metadata:
   name: test-app  # 应用名称
-  namespace: default  # 命名空间，默认为default
-`,
+  namespace: default  # 命名空间，默认为default`,
 		},
 		{
 			name: "行首注释块",
@@ -58,8 +57,7 @@ metadata:
   name: my-app
   # 中间注释
   labels:
-    app: my-app  # 标签注释
-`,
+    app: my-app  # 标签注释`,
 		},
 		{
 			name: "多级缩进注释",
@@ -89,8 +87,7 @@ data:
     app:
       name: demo-app  # 应用名称
       # 端口配置
-      port: 9000  # 默认端口8080
-`,
+      port: 9000  # 默认端口8080`,
 		},
 	}
 
@@ -149,8 +146,7 @@ metadata:
     description: "这个pod使用了#for和#if语法在注释中"  # 这里有#for
 spec:
   containers:
-  - name: main
-`,
+  - name: main`,
 		},
 		{
 			name: "行中间的#字符",
@@ -177,8 +173,7 @@ metadata:
     example.com/hash-config: "key1#value1,key2#value2"  # 值中包含#
     example.com/command: "echo 'process #1 is running'"  # 命令中的#
 spec:
-  replicas: 3
-`,
+  replicas: 3`,
 		},
 		{
 			name: "空行和空白字符处理",
@@ -215,8 +210,7 @@ spec:
   # 包含空白字符的行
   	
   ports:
-  - port: 80
-`,
+  - port: 80`,
 		},
 		{
 			name: "注释与表达式在同一行",
@@ -242,8 +236,7 @@ data:
   config: |
     # 内嵌YAML配置
     app_name: myapp  # 应用名：myapp
-    debug: true  # 调试模式，默认false
-`,
+    debug: true  # 调试模式，默认false`,
 		},
 		{
 			name: "多行字符串中的注释",
@@ -277,8 +270,7 @@ data:
     # 更多注释
     if [ "production" = "production" ]; then  # 环境检查
       echo "Production mode"
-    fi
-`,
+    fi`,
 		},
 	}
 
@@ -469,8 +461,7 @@ spec:
   type: LoadBalancer  # 服务类型
   ports:
   - port: 80  # 服务端口
-    name: http  # 端口名称
-`,
+    name: http  # 端口名称`,
 		},
 	}
 